@@ -0,0 +1,147 @@
+package apierror
+
+// Controllers and middleware return an *Error instead of writing the response
+// themselves, and Handler renders every error the same way:
+//
+//	{"errorCode": 404, "code": "ROOM_NOT_FOUND", "error": "Room Not Found"}
+//
+// Validation errors list what is wrong with each field under "fields", and
+// some errors carry extra details, like how long to wait under "retry_after".
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type Error struct {
+	Status  int
+	Code    Code
+	Message string
+	Fields  []FieldError
+	Details fiber.Map
+}
+
+// FieldError is what is wrong with a single field of the request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func New(status int, code Code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// With adds a detail to the body of the error.
+func (e *Error) With(key string, value interface{}) *Error {
+	if e.Details == nil {
+		e.Details = fiber.Map{}
+	}
+
+	e.Details[key] = value
+
+	return e
+}
+
+// The request couldn't be read at all.
+func BadRequest(message string) *Error {
+	return New(fiber.StatusBadRequest, InvalidRequest, message)
+}
+
+// Nobody is signed in.
+func Unauthorized() *Error {
+	return New(fiber.StatusUnauthorized, Unauthenticated, "Unauthorized")
+}
+
+// Someone is signed in, but can't do this.
+func Forbidden(code Code, message string) *Error {
+	return New(fiber.StatusForbidden, code, message)
+}
+
+func NotFound(code Code, message string) *Error {
+	return New(fiber.StatusNotFound, code, message)
+}
+
+// The request clashes with how things are right now.
+func Conflict(code Code, message string) *Error {
+	return New(fiber.StatusConflict, code, message)
+}
+
+// The request could be read, but some of its fields are wrong.
+func Validation(fields ...FieldError) *Error {
+	message := "Validation Failed"
+	if len(fields) == 1 {
+		message = fields[0].Message
+	}
+
+	err := New(fiber.StatusUnprocessableEntity, ValidationFailed, message)
+	err.Fields = fields
+
+	return err
+}
+
+func Field(field string, message string) FieldError {
+	return FieldError{Field: field, Message: message}
+}
+
+// Too many requests in too short a time. How long to wait is rounded up to
+// whole seconds and sent under "retry_after" and in the Retry-After header.
+func TooManyRequests(code Code, message string, wait time.Duration) *Error {
+	return New(fiber.StatusTooManyRequests, code, message).With("retry_after", max(1, int(math.Ceil(wait.Seconds()))))
+}
+
+// Something went wrong on our side. The message says what was being done.
+func InternalError(message string) *Error {
+	return New(fiber.StatusInternalServerError, Internal, message)
+}
+
+// Handler is the fiber ErrorHandler. Errors from fiber itself get a code
+// from their status, anything else is logged and hidden behind a 500.
+func Handler(c *fiber.Ctx, err error) error {
+	var apiError *Error
+	var fiberError *fiber.Error
+
+	switch {
+	case errors.As(err, &apiError):
+	case errors.As(err, &fiberError):
+		code, ok := statusCodes[fiberError.Code]
+		if !ok {
+			code = InvalidRequest
+			if fiberError.Code >= fiber.StatusInternalServerError {
+				code = Internal
+			}
+		}
+		apiError = New(fiberError.Code, code, fiberError.Message)
+	default:
+		log.Println("Unhandled Error:", err)
+		apiError = InternalError("Internal Server Error")
+	}
+
+	body := fiber.Map{}
+
+	for key, value := range apiError.Details {
+		body[key] = value
+	}
+
+	body["errorCode"] = apiError.Status
+	body["code"] = apiError.Code
+	body["error"] = apiError.Message
+
+	if len(apiError.Fields) > 0 {
+		body["fields"] = apiError.Fields
+	}
+
+	if retryAfter, ok := apiError.Details["retry_after"].(int); ok {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	}
+
+	return c.Status(apiError.Status).JSON(body)
+}
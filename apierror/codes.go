@@ -0,0 +1,74 @@
+package apierror
+
+// Code tells clients what went wrong without them having to read the message.
+type Code string
+
+const (
+	// 400 and 422
+	InvalidRequest   Code = "INVALID_REQUEST"
+	ValidationFailed Code = "VALIDATION_FAILED"
+
+	// 401
+	Unauthenticated    Code = "UNAUTHENTICATED"
+	InvalidCredentials Code = "INVALID_CREDENTIALS"
+
+	// 403
+	MissingPermission Code = "MISSING_PERMISSION"
+	RoleHierarchy     Code = "ROLE_HIERARCHY"
+	OwnerOnly         Code = "OWNER_ONLY"
+	SystemRole        Code = "SYSTEM_ROLE"
+	NotAuthor         Code = "NOT_AUTHOR"
+	RoomArchived      Code = "ROOM_ARCHIVED"
+	Banned            Code = "BANNED"
+	Muted             Code = "MUTED"
+	NotMember         Code = "NOT_A_MEMBER"
+	InviteRequired    Code = "INVITE_REQUIRED"
+	InvalidInvite     Code = "INVALID_INVITE"
+	InvalidPassphrase Code = "INVALID_PASSPHRASE"
+	InvalidOwnerToken Code = "INVALID_OWNER_TOKEN"
+
+	// 404
+	EndpointNotFound  Code = "ENDPOINT_NOT_FOUND"
+	BanNotFound       Code = "BAN_NOT_FOUND"
+	CategoryNotFound  Code = "CATEGORY_NOT_FOUND"
+	CommandNotFound   Code = "COMMAND_NOT_FOUND"
+	InviteNotFound    Code = "INVITE_NOT_FOUND"
+	MemberNotFound    Code = "MEMBER_NOT_FOUND"
+	MessageNotFound   Code = "MESSAGE_NOT_FOUND"
+	OverwriteNotFound Code = "OVERWRITE_NOT_FOUND"
+	ReactionNotFound  Code = "REACTION_NOT_FOUND"
+	RoleNotFound      Code = "ROLE_NOT_FOUND"
+	RoomNotFound      Code = "ROOM_NOT_FOUND"
+	SessionNotFound   Code = "SESSION_NOT_FOUND"
+
+	// 409
+	MemberExists     Code = "MEMBER_EXISTS"
+	RoleExists       Code = "ROLE_EXISTS"
+	ReactionExists   Code = "REACTION_EXISTS"
+	CategoryNotEmpty Code = "CATEGORY_NOT_EMPTY"
+	InviteUsed       Code = "INVITE_USED"
+	MemberNotMuted   Code = "MEMBER_NOT_MUTED"
+	AlreadyOwner     Code = "ALREADY_OWNER"
+	ChangedMeanwhile Code = "CHANGED_MEANWHILE"
+
+	// 426
+	UpgradeRequired Code = "UPGRADE_REQUIRED"
+
+	// 429
+	RateLimited Code = "RATE_LIMITED"
+	SlowMode    Code = "SLOW_MODE"
+
+	// 500
+	Internal Code = "INTERNAL_ERROR"
+)
+
+// Codes for statuses that errors from fiber itself come with.
+var statusCodes = map[int]Code{
+	400: InvalidRequest,
+	401: Unauthenticated,
+	403: MissingPermission,
+	404: EndpointNotFound,
+	422: ValidationFailed,
+	426: UpgradeRequired,
+	429: RateLimited,
+}
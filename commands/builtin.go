@@ -0,0 +1,44 @@
+package commands
+
+import (
+	"eskimoe-server/config"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	Register(Command{
+		Name:        "help",
+		Description: "Lists the commands you can run here",
+		Usage:       "/help",
+		Run:         help,
+	})
+
+	Register(Command{
+		Name:        "ping",
+		Description: "Checks that the server is listening",
+		Usage:       "/ping",
+		Run: func(ctx Context) (string, error) {
+			return "Pong!", nil
+		},
+	})
+
+	Register(Command{
+		Name:        "version",
+		Description: "Shows the version of the server",
+		Usage:       "/version",
+		Run: func(ctx Context) (string, error) {
+			return fmt.Sprintf("%s %s", config.Name, config.Version), nil
+		},
+	})
+}
+
+func help(ctx Context) (string, error) {
+	lines := []string{}
+
+	for _, command := range Available(ctx) {
+		lines = append(lines, fmt.Sprintf("%s - %s", command.Usage, command.Description))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
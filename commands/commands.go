@@ -0,0 +1,117 @@
+package commands
+
+// Commands are run by sending "/name arguments" to a commands room. They are
+// not stored as messages, their output only goes back to whoever ran them.
+
+import (
+	"errors"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"slices"
+	"strings"
+)
+
+type Context struct {
+	Member      database.Member
+	Room        database.Room
+	Permissions permissions.Set // The member's permissions in the room.
+	Args        []string
+}
+
+type Command struct {
+	Name        string
+	Description string
+	Usage       string
+	// Permission is needed on top of run_commands, if set.
+	Permission database.Permission
+	Run        func(ctx Context) (string, error)
+}
+
+type Response struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+}
+
+var ErrNotCommand = errors.New("not a command")
+var ErrUnknownCommand = errors.New("unknown command")
+var ErrMissingPermission = errors.New("missing permission")
+
+// UsageError is returned by commands run with the wrong arguments.
+type UsageError struct {
+	Usage string
+}
+
+func (e UsageError) Error() string {
+	return "Usage: " + e.Usage
+}
+
+var registry = map[string]Command{}
+
+// Register makes a command available in every commands room.
+// Registering a name twice replaces the earlier command.
+func Register(command Command) {
+	registry[strings.ToLower(command.Name)] = command
+}
+
+// Parse splits "/name arguments" into the lowercased name and its arguments.
+func Parse(input string) (string, []string, bool) {
+	input = strings.TrimSpace(input)
+
+	if !strings.HasPrefix(input, "/") {
+		return "", nil, false
+	}
+
+	fields := strings.Fields(input[1:])
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+
+	return strings.ToLower(fields[0]), fields[1:], true
+}
+
+// Run parses the input and runs the command it names.
+func Run(ctx Context, input string) (Response, error) {
+	name, args, ok := Parse(input)
+	if !ok {
+		return Response{}, ErrNotCommand
+	}
+
+	command, ok := registry[name]
+	if !ok {
+		return Response{}, ErrUnknownCommand
+	}
+
+	if !allowed(ctx, command) {
+		return Response{}, ErrMissingPermission
+	}
+
+	ctx.Args = args
+
+	output, err := command.Run(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return Response{Command: command.Name, Output: output}, nil
+}
+
+// Available returns the commands the member can run in the room, sorted by name.
+func Available(ctx Context) []Command {
+	available := []Command{}
+
+	for _, command := range registry {
+		if allowed(ctx, command) {
+			available = append(available, command)
+		}
+	}
+
+	slices.SortFunc(available, func(a, b Command) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return available
+}
+
+func allowed(ctx Context, command Command) bool {
+	return ctx.Permissions.Has(database.RunCommands) && (command.Permission == "" || ctx.Permissions.Has(command.Permission))
+}
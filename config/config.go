@@ -4,6 +4,9 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,10 +17,22 @@ var Owner string
 var OwnerToken string
 var Version string
 var Port string
+var Host string
 var DatabaseDriver string
 var DSN string
+var IdleTimeout time.Duration
+var ReplayBufferSize int
+var ReplayPersist bool
+var SessionLifetime time.Duration
+var DefaultRateLimit RateLimit
+var AuthRateLimit RateLimit
+var MessageRateLimit RateLimit
+var SocketRateLimit RateLimit
+var SocketFrameSize int64
 
-func init() {
+// Load reads the configuration from the environment and the .env file.
+// It has to run before anything else is set up.
+func Load() {
 	isAlpha := regexp.MustCompile(`^[A-Za-z]+$`).MatchString
 	if err := godotenv.Load(); err != nil {
 		log.Fatal("Error loading Environment Variables")
@@ -54,6 +69,13 @@ func init() {
 	}
 	log.Default().Println("Server Port:", Port)
 
+	// Members sign this, not whatever host a request names, when they log in with a key
+	Host = os.Getenv("PUBLIC_HOST")
+	if Host == "" {
+		log.Fatal("Public Host not found in Environment Variables")
+	}
+	log.Default().Println("Public Host:", Host)
+
 	Owner = os.Getenv("OWNER_ID")
 	if Owner == "" {
 		log.Fatal("Owner ID not found in Environment Variables")
@@ -73,4 +95,72 @@ func init() {
 	if DSN == "" {
 		log.Fatal("DSN not found in Environment Variables")
 	}
+
+	IdleTimeout = 5 * time.Minute
+	if idleTimeout := os.Getenv("IDLE_TIMEOUT"); idleTimeout != "" {
+		seconds, err := strconv.Atoi(idleTimeout)
+		if err != nil || seconds <= 0 {
+			log.Fatal("Idle Timeout must be a positive number of seconds")
+		}
+		IdleTimeout = time.Duration(seconds) * time.Second
+	}
+
+	ReplayBufferSize = 1000
+	if replayBufferSize := os.Getenv("REPLAY_BUFFER_SIZE"); replayBufferSize != "" {
+		size, err := strconv.Atoi(replayBufferSize)
+		if err != nil || size <= 0 {
+			log.Fatal("Replay Buffer Size must be a positive number")
+		}
+		ReplayBufferSize = size
+	}
+
+	ReplayPersist = os.Getenv("REPLAY_PERSIST") == "true"
+
+	SessionLifetime = 30 * 24 * time.Hour
+	if sessionLifetime := os.Getenv("SESSION_LIFETIME"); sessionLifetime != "" {
+		seconds, err := strconv.Atoi(sessionLifetime)
+		if err != nil || seconds <= 0 {
+			log.Fatal("Session Lifetime must be a positive number of seconds")
+		}
+		SessionLifetime = time.Duration(seconds) * time.Second
+	}
+
+	DefaultRateLimit = parseRateLimit("RATE_LIMIT", RateLimit{Requests: 120, Per: time.Minute})
+	AuthRateLimit = parseRateLimit("RATE_LIMIT_AUTH", RateLimit{Requests: 10, Per: time.Minute})
+	MessageRateLimit = parseRateLimit("RATE_LIMIT_MESSAGES", RateLimit{Requests: 10, Per: 10 * time.Second})
+	SocketRateLimit = parseRateLimit("RATE_LIMIT_SOCKET", RateLimit{Requests: 30, Per: 10 * time.Second})
+
+	SocketFrameSize = 4096
+	if socketFrameSize := os.Getenv("SOCKET_FRAME_SIZE"); socketFrameSize != "" {
+		size, err := strconv.ParseInt(socketFrameSize, 10, 64)
+		if err != nil || size <= 0 {
+			log.Fatal("Socket Frame Size must be a positive number of bytes")
+		}
+		SocketFrameSize = size
+	}
+}
+
+// Reads a "requests/seconds" budget from the environment, or the fallback if it isn't set.
+func parseRateLimit(name string, fallback RateLimit) RateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	requests, seconds, found := strings.Cut(value, "/")
+	if !found {
+		log.Fatal(name + " must be written as requests/seconds")
+	}
+
+	count, err := strconv.Atoi(requests)
+	if err != nil || count <= 0 {
+		log.Fatal(name + " must allow a positive number of requests")
+	}
+
+	period, err := strconv.Atoi(seconds)
+	if err != nil || period <= 0 {
+		log.Fatal(name + " must be over a positive number of seconds")
+	}
+
+	return RateLimit{Requests: count, Per: time.Duration(period) * time.Second}
 }
@@ -1,5 +1,14 @@
 package config
 
+import "time"
+
+// RateLimit is a budget of requests that refills over a period, written as
+// "requests/seconds" in the environment.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
 // Socket Broadcast Struct
 
 type BroadcastType int
@@ -28,9 +37,19 @@ const (
 	RoleCreated
 	RoleDeleted
 	RoleUpdated
+	LogCreated
+	MemberTyping
+	SessionStarted
+	SessionResumed
+	ResyncRequired
+	ServerUpdated
+	ServerReactionDeleted
+	ServerReactionCreated
+	ServerReactionUpdated
 )
 
 type SocketBroadcast struct {
 	BroadcastType BroadcastType `json:"broadcast_type"`
+	Sequence      uint64        `json:"seq,omitempty"`
 	Data          interface{}   `json:"data"`
 }
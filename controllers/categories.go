@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/socket"
+	"eskimoe-server/utils"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func CreateCategory(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	categoryCreationStruct := new(struct {
+		Name string `json:"name"`
+	})
+
+	if err := c.BodyParser(categoryCreationStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	name := strings.TrimSpace(categoryCreationStruct.Name)
+
+	if name == "" {
+		return apierror.Validation(apierror.Field("name", "Category name cannot be empty"))
+	}
+
+	newCategory := database.Category{
+		Name:      name,
+		RoomOrder: []int{},
+		ServerID:  member.ServerID,
+	}
+
+	if err := database.Database.Transaction(func(tx *gorm.DB) error {
+		var server database.Server
+
+		if err := tx.First(&server, member.ServerID).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&newCategory).Error; err != nil {
+			return err
+		}
+
+		server.CategoryOrder = append(server.CategoryOrder, newCategory.ID)
+
+		if err := tx.Model(&server).Update("category_order", server.CategoryOrder).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.CategoryCreated,
+			Content:  fmt.Sprintf("Category %s created", newCategory.Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Creating Category")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.CategoryCreated,
+		Data:          newCategory,
+	}}
+
+	return c.Status(fiber.StatusCreated).JSON(newCategory)
+}
+
+func UpdateCategory(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	categoryUpdateStruct := new(struct {
+		Name string `json:"name"`
+	})
+
+	if err := c.BodyParser(categoryUpdateStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	db := database.Database
+
+	var category database.Category
+
+	categoryID, err := c.ParamsInt("category")
+
+	if err != nil || db.First(&category, categoryID).Error != nil {
+		return apierror.NotFound(apierror.CategoryNotFound, "Category Not Found")
+	}
+
+	name := strings.TrimSpace(categoryUpdateStruct.Name)
+
+	if name == "" || name == category.Name {
+		return c.Status(fiber.StatusOK).JSON(category)
+	}
+
+	previousName := category.Name
+	category.Name = name
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&category).Update("name", category.Name).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.CategoryUpdated,
+			Content:  fmt.Sprintf("Category %s updated.\nName: %s", previousName, category.Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Updating Category")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{FilterRooms: true, Broadcast: config.SocketBroadcast{
+		BroadcastType: config.CategoryUpdated,
+		Data:          category,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(category)
+}
+
+// Deletes the category passed in the URL. A category with rooms can only be
+// deleted by either moving its rooms to another category (?move_to=<id>)
+// or deleting them along with their messages (?delete_rooms=true).
+func DeleteCategory(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var category database.Category
+
+	categoryID, err := c.ParamsInt("category")
+
+	if err != nil || db.Preload("Rooms").First(&category, categoryID).Error != nil {
+		return apierror.NotFound(apierror.CategoryNotFound, "Category Not Found")
+	}
+
+	moveTo := c.QueryInt("move_to")
+	deleteRooms := c.QueryBool("delete_rooms")
+
+	if moveTo != 0 && deleteRooms {
+		return apierror.Validation(apierror.Field("delete_rooms", "Rooms can either be moved or deleted, not both"))
+	}
+
+	if len(category.Rooms) > 0 && moveTo == 0 && !deleteRooms {
+		return apierror.Conflict(apierror.CategoryNotEmpty, "Category has rooms, move them with move_to or delete them with delete_rooms")
+	}
+
+	var target database.Category
+
+	if moveTo != 0 {
+		if moveTo == category.ID || db.First(&target, moveTo).Error != nil {
+			return apierror.Validation(apierror.Field("move_to", "Invalid Category to move rooms to"))
+		}
+	}
+
+	roomIDs := []int{}
+	for _, room := range category.Rooms {
+		roomIDs = append(roomIDs, room.ID)
+	}
+
+	logContent := fmt.Sprintf("Category %s deleted", category.Name)
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if len(roomIDs) > 0 {
+			if moveTo != 0 {
+				// Moved rooms keep their order, after the rooms already in the target
+				target.RoomOrder = append(target.RoomOrder, utils.OrderedIDs(category.RoomOrder, roomIDs)...)
+
+				if err := tx.Model(&database.Room{}).Where("category_id = ?", category.ID).Update("category_id", target.ID).Error; err != nil {
+					return err
+				}
+
+				if err := tx.Model(&target).Update("room_order", target.RoomOrder).Error; err != nil {
+					return err
+				}
+
+				logContent = fmt.Sprintf("%s. %d room(s) moved to Category %s", logContent, len(roomIDs), target.Name)
+			} else {
+				if err := deleteRoomsWithMessages(tx, roomIDs); err != nil {
+					return err
+				}
+
+				logContent = fmt.Sprintf("%s along with %d room(s)", logContent, len(roomIDs))
+			}
+		}
+
+		if err := tx.Delete(&category).Error; err != nil {
+			return err
+		}
+
+		var server database.Server
+
+		if err := tx.First(&server, category.ServerID).Error; err != nil {
+			return err
+		}
+
+		server.CategoryOrder = utils.WithoutID(server.CategoryOrder, category.ID)
+
+		if err := tx.Model(&server).Update("category_order", server.CategoryOrder).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.CategoryDeleted,
+			Content:  logContent,
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Deleting Category")
+	}
+
+	deletedData := struct {
+		CategoryID   int   `json:"category_id"`
+		MovedTo      int   `json:"moved_to,omitempty"`
+		DeletedRooms []int `json:"deleted_rooms"`
+	}{
+		CategoryID:   category.ID,
+		MovedTo:      moveTo,
+		DeletedRooms: []int{},
+	}
+
+	if deleteRooms {
+		deletedData.DeletedRooms = roomIDs
+
+		for _, roomID := range roomIDs {
+			socket.WsHub.Overwrites <- roomID
+		}
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.CategoryDeleted,
+		Data:          deletedData,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(deletedData)
+}
+
+// Replaces the server's category order. The new order must list every category exactly once.
+func UpdateCategoryOrder(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	categoryOrderStruct := new(struct {
+		Order []int `json:"order"`
+	})
+
+	if err := c.BodyParser(categoryOrderStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	db := database.Database
+
+	var server database.Server
+
+	if err := db.First(&server, member.ServerID).Error; err != nil {
+		return apierror.InternalError("Error Finding Server")
+	}
+
+	var categoryIDs []int
+
+	if err := db.Model(&database.Category{}).Where("server_id = ?", server.ID).Pluck("id", &categoryIDs).Error; err != nil {
+		return apierror.InternalError("Error Finding Categories")
+	}
+
+	if !utils.SameIDs(categoryOrderStruct.Order, categoryIDs) {
+		return apierror.Validation(apierror.Field("order", "Order must contain every category exactly once"))
+	}
+
+	server.CategoryOrder = categoryOrderStruct.Order
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&server).Update("category_order", server.CategoryOrder).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.CategoryUpdated,
+			Content:  "Category order updated",
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Updating Category Order")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.CategoryOrderUpdated,
+		Data:          fiber.Map{"category_order": server.CategoryOrder},
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"category_order": server.CategoryOrder,
+	})
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"eskimoe-server/apierror"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/utils"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Members with generate_invites can create invites and see or revoke their own,
+// members with manage_invites can see and revoke every invite.
+
+const inviteCodeLength = 10
+
+// Returns the invites the member can see, newest first.
+func Invites(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	query := db.Preload("GeneratedBy").Preload("UsedBy").Where("server_id = ?", member.ServerID)
+
+	if !permissions.Has(member, database.ManageInvites) {
+		query = query.Where("generated_by_id = ?", member.ID)
+	}
+
+	invites := []database.Invite{}
+
+	if err := query.Order("id desc").Find(&invites).Error; err != nil {
+		return apierror.InternalError("Error Finding Invites")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(invites)
+}
+
+// Generates a new invite. Invites never expire and can be used any number
+// of times unless expires_in (in seconds) or max_uses are given.
+func CreateInvite(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	inviteCreationStruct := new(struct {
+		ExpiresIn int `json:"expires_in"`
+		MaxUses   int `json:"max_uses"`
+	})
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(inviteCreationStruct); err != nil {
+			return apierror.BadRequest("Invalid Request")
+		}
+	}
+
+	fields := []apierror.FieldError{}
+
+	if inviteCreationStruct.ExpiresIn < 0 {
+		fields = append(fields, apierror.Field("expires_in", "Expiry cannot be negative"))
+	}
+
+	if inviteCreationStruct.MaxUses < 0 {
+		fields = append(fields, apierror.Field("max_uses", "Maximum uses cannot be negative"))
+	}
+
+	if len(fields) > 0 {
+		return apierror.Validation(fields...)
+	}
+
+	invite := database.Invite{
+		MaxUses:       inviteCreationStruct.MaxUses,
+		GeneratedByID: member.ID,
+		ServerID:      member.ServerID,
+	}
+
+	if inviteCreationStruct.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(inviteCreationStruct.ExpiresIn) * time.Second)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	// Codes are random enough to never collide in practice, but the unique index gets the last word
+	var err error
+
+	for attempt := 0; attempt < 3; attempt++ {
+		invite.Code, err = utils.RandomCode(inviteCodeLength)
+		if err != nil {
+			break
+		}
+
+		err = database.Database.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&invite).Error; err != nil {
+				return err
+			}
+
+			return tx.Create(&database.Log{
+				Type:     database.InviteGenerated,
+				Content:  fmt.Sprintf("Invite %s generated by %s", invite.Code, member.DisplayName),
+				MemberID: member.ID,
+				ServerID: member.ServerID,
+			}).Error
+		})
+
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return apierror.InternalError("Error Creating Invite")
+	}
+
+	member.Roles = nil
+	invite.GeneratedBy = member
+	invite.UsedBy = []database.Member{}
+
+	return c.Status(fiber.StatusCreated).JSON(invite)
+}
+
+// Revokes the invite passed in the URL. Unused invites are deleted, invites
+// members have already joined with are kept for the record but can't be used again.
+func DeleteInvite(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var invite database.Invite
+
+	if err := db.Where("code = ? AND server_id = ?", c.Params("invite"), member.ServerID).First(&invite).Error; err != nil {
+		return apierror.NotFound(apierror.InviteNotFound, "Invite Not Found")
+	}
+
+	if invite.GeneratedByID != member.ID && !permissions.Has(member, database.ManageInvites) {
+		return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
+	}
+
+	if invite.Used {
+		return apierror.Conflict(apierror.InviteUsed, "Invite already used up or revoked")
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		// Only delete the invite if nobody joined with it in the meantime
+		result := tx.Where("id = ? AND uses = ?", invite.ID, 0).Delete(&database.Invite{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		logContent := fmt.Sprintf("Invite %s deleted", invite.Code)
+
+		if result.RowsAffected == 0 {
+			if err := tx.Model(&invite).Update("used", true).Error; err != nil {
+				return err
+			}
+			logContent = fmt.Sprintf("Invite %s revoked", invite.Code)
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.InviteDeleted,
+			Content:  logContent,
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Deleting Invite")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Invite Deleted",
+	})
+}
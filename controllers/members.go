@@ -1,12 +1,22 @@
 package controllers
 
 import (
+	"crypto/subtle"
+	"errors"
+	"eskimoe-server/apierror"
 	"eskimoe-server/config"
 	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/sessions"
+	"eskimoe-server/socket"
+	"eskimoe-server/utils"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 func JoinServer(c *fiber.Ctx) error {
@@ -16,121 +26,343 @@ func JoinServer(c *fiber.Ctx) error {
 		UniqueID    string `json:"unique_id"`
 		UniqueToken string `json:"unique_token"`
 		DisplayName string `json:"display_name"`
+		InviteCode  string `json:"invite_code"`
+		Passphrase  string `json:"passphrase"`
+		Device      string `json:"device"`
+		OwnerToken  string `json:"owner_token"`
+		// Members can sign in with a key instead of a unique token
+		PublicKey string `json:"public_key"`
+		Nonce     string `json:"nonce"`
+		Signature string `json:"signature"`
 	})
 
 	if err := c.BodyParser(member); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"errorCode": fiber.StatusBadRequest,
-			"error":     "Invalid Request Body",
-		})
+		return apierror.BadRequest("Invalid Request Body")
 	}
 
 	// Empty Values Check
-	if member.UniqueID == "" || member.UniqueToken == "" || member.DisplayName == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"errorCode": fiber.StatusBadRequest,
-			"error":     "One or more fields are empty",
-		})
+	fields := []apierror.FieldError{}
+
+	if member.UniqueID == "" {
+		fields = append(fields, apierror.Field("unique_id", "Unique ID cannot be empty"))
+	}
+
+	if member.UniqueToken == "" && member.PublicKey == "" {
+		fields = append(fields, apierror.Field("unique_token", "Either a unique token or a public key is needed"))
+	}
+
+	if member.DisplayName == "" {
+		fields = append(fields, apierror.Field("display_name", "Display name cannot be empty"))
+	}
+
+	if member.PublicKey != "" && !sessions.ValidPublicKey(member.PublicKey) {
+		fields = append(fields, apierror.Field("public_key", "Invalid Public Key"))
+	}
+
+	if len(fields) > 0 {
+		return apierror.Validation(fields...)
 	}
 
 	// Check if Member Exists
 	var existingMember database.Member
 	if db.Where("unique_id = ?", member.UniqueID).First(&existingMember).Error == nil {
-		if existingMember.Status != "left" {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"errorCode": fiber.StatusBadRequest,
-				"error":     "Member already exists",
-			})
+		if !slices.Contains(database.DepartedStatuses, existingMember.Status) {
+			return apierror.Conflict(apierror.MemberExists, "Member already exists")
+		}
+
+		// Only whoever joined with the unique id can come back with it
+		if !verifyCredentials(existingMember, member.UniqueToken, member.Nonce, member.Signature) {
+			return apierror.New(fiber.StatusUnauthorized, apierror.InvalidCredentials, "Invalid Credentials")
+		}
+
+		// Banned members can only come back once their ban is over
+		var ban database.Ban
+		if existingMember.Status == database.Banned && db.Where("member_id = ?", existingMember.ID).First(&ban).Error == nil && ban.Active() {
+			return apierror.Forbidden(apierror.Banned, "Banned").
+				With("reason", ban.Reason).
+				With("expires_at", ban.ExpiresAt)
+		}
+	}
+
+	var server database.Server
+	if err := db.First(&server).Error; err != nil {
+		return apierror.InternalError("Error Finding Server")
+	}
+
+	// Anyone could pick the owner's unique id, so the owner proves itself with OWNER_TOKEN the first time
+	if existingMember.ID == 0 && member.UniqueID == server.Owner && subtle.ConstantTimeCompare([]byte(member.OwnerToken), []byte(config.OwnerToken)) != 1 {
+		return apierror.Forbidden(apierror.InvalidOwnerToken, "Invalid Owner Token")
+	}
+
+	newMember := database.Member{
+		UniqueID:    member.UniqueID,
+		PublicKey:   member.PublicKey,
+		DisplayName: member.DisplayName,
+		ServerID:    server.ID,
+		Status:      database.Offline,
+	}
+
+	// The owner can always join, otherwise nobody could let anyone in
+	useInvite := false
+
+	if !permissions.IsOwner(newMember) {
+		switch server.Mode {
+		case database.Passphrase:
+			if member.Passphrase == "" || bcrypt.CompareHashAndPassword([]byte(server.Passphrase), []byte(member.Passphrase)) != nil {
+				return apierror.Forbidden(apierror.InvalidPassphrase, "Invalid Passphrase")
+			}
+		case database.InviteOnly:
+			if member.InviteCode == "" {
+				return apierror.Forbidden(apierror.InviteRequired, "Invite Required")
+			}
+			useInvite = true
+			newMember.InviteCode = member.InviteCode
 		}
 	}
 
-	// encrypt the token
-	encryptedToken, err := bcrypt.GenerateFromPassword([]byte(member.UniqueToken), bcrypt.DefaultCost)
+	// Members joining with only a key get a unique token nobody knows
+	uniqueToken := member.UniqueToken
+
+	if uniqueToken == "" {
+		var err error
+		if uniqueToken, err = utils.RandomCode(32); err != nil {
+			return apierror.InternalError("Error Encrypting Token")
+		}
+	}
+
+	// The unique token is only ever checked, so only its hash is kept
+	encryptedToken, err := bcrypt.GenerateFromPassword([]byte(uniqueToken), bcrypt.DefaultCost)
 
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Encrypting Token",
-		})
+		return apierror.InternalError("Error Encrypting Token")
 	}
 
 	everyoneRole := database.Role{}
 
 	if err := db.Where("name = ?", "everyone").First(&everyoneRole).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Finding System Role",
-		})
+		return apierror.InternalError("Error Finding System Role")
 	}
 
 	// Create Member
-	joinedAt := time.Now()
-	var server database.Server
-	if err := db.First(&server).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Finding Server",
-		})
-	}
+	newMember.UniqueToken = string(encryptedToken)
+	newMember.Roles = []database.Role{everyoneRole}
+	newMember.JoinedAt = time.Now()
+
+	var session database.Session
+	var token string
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		// member can leave and rejoin, so update if exists or create if not
+		if existingMember.ID != 0 {
+			if err := tx.Where("member_id = ?", existingMember.ID).Delete(&database.Ban{}).Error; err != nil {
+				return err
+			}
+
+			// Only what joining sets is written, so a timeout outlives leaving and coming back
+			newMember.ID = existingMember.ID
+			if err := tx.Model(&newMember).
+				Select("UniqueToken", "PublicKey", "DisplayName", "InviteCode", "ServerID", "Status", "JoinedAt").
+				Updates(&newMember).Error; err != nil {
+				return err
+			}
+
+			// Rejoining starts over with only the everyone role
+			if err := tx.Model(&newMember).Association("Roles").Replace(newMember.Roles); err != nil {
+				return err
+			}
+
+			newMember.About = existingMember.About
+			newMember.Pronouns = existingMember.Pronouns
+			newMember.MutedUntil = existingMember.MutedUntil
+		} else {
+			if err := tx.Create(&newMember).Error; err != nil {
+				return err
+			}
+		}
 
-	newMember := database.Member{
-		UniqueID:    member.UniqueID,
-		UniqueToken: member.UniqueToken,
-		AuthToken:   string(encryptedToken),
-		DisplayName: member.DisplayName,
-		Roles:       []database.Role{everyoneRole},
-		ServerID:    server.ID,
-		Status:      database.Online,
-		JoinedAt:    joinedAt,
-	}
-
-	// member can leave and rejoin, so update if exists or create if not
-	if existingMember.ID != 0 {
-		newMember.ID = existingMember.ID
-		if err := db.Save(&newMember).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"errorCode": fiber.StatusInternalServerError,
-				"error":     "Error Updating Member",
-			})
+		if useInvite {
+			if err := claimInvite(tx, member.InviteCode, newMember); err != nil {
+				return err
+			}
 		}
-	} else {
-		if err := db.Create(&newMember).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"errorCode": fiber.StatusInternalServerError,
-				"error":     "Error Creating Member",
-			})
+
+		var err error
+		session, token, err = sessions.New(tx, newMember.ID, member.Device)
+		return err
+	}); err != nil {
+		if errors.Is(err, errInvalidInvite) {
+			return apierror.Forbidden(apierror.InvalidInvite, "Invalid Invite")
 		}
+
+		return apierror.InternalError("Error Creating Member")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"message":    "Member Created",
 		"member":     newMember,
-		"auth_token": string(encryptedToken),
+		"auth_token": token,
+		"session":    session,
 	})
 }
 
+var errInvalidInvite = errors.New("invite is invalid, expired or used up")
+
+// Uses up one use of the invite for the member joining with it.
+func claimInvite(tx *gorm.DB, code string, member database.Member) error {
+	// Claiming a use of the invite is a single update, so concurrent joins can't overuse it
+	result := tx.Model(&database.Invite{}).
+		Where("code = ? AND used = ? AND server_id = ?", code, false, member.ServerID).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Updates(map[string]interface{}{
+			"uses": gorm.Expr("uses + 1"),
+			"used": gorm.Expr("CASE WHEN max_uses <> 0 AND uses + 1 >= max_uses THEN ? ELSE ? END", true, false),
+		})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errInvalidInvite
+	}
+
+	var invite database.Invite
+
+	if err := tx.Where("code = ?", code).First(&invite).Error; err != nil {
+		return err
+	}
+
+	usedBy := member
+	usedBy.Roles = nil
+
+	if err := tx.Model(&invite).Association("UsedBy").Append(&usedBy); err != nil {
+		return err
+	}
+
+	return tx.Create(&database.Log{
+		Type:     database.InviteUsed,
+		Content:  fmt.Sprintf("%s joined with Invite %s", member.DisplayName, code),
+		MemberID: member.ID,
+		ServerID: member.ServerID,
+	}).Error
+}
+
+// Signs a returning member in on a new device, with either its unique token
+// or a signed challenge if it registered a public key.
+func Login(c *fiber.Ctx) error {
+	db := database.Database
+
+	loginStruct := new(struct {
+		UniqueID    string `json:"unique_id"`
+		UniqueToken string `json:"unique_token"`
+		Nonce       string `json:"nonce"`
+		Signature   string `json:"signature"`
+		Device      string `json:"device"`
+	})
+
+	if err := c.BodyParser(loginStruct); err != nil {
+		return apierror.BadRequest("Invalid Request Body")
+	}
+
+	fields := []apierror.FieldError{}
+
+	if loginStruct.UniqueID == "" {
+		fields = append(fields, apierror.Field("unique_id", "Unique ID cannot be empty"))
+	}
+
+	if loginStruct.UniqueToken == "" && loginStruct.Signature == "" {
+		fields = append(fields, apierror.Field("unique_token", "Either a unique token or a signature is needed"))
+	}
+
+	if len(fields) > 0 {
+		return apierror.Validation(fields...)
+	}
+
+	var member database.Member
+
+	if err := db.Where("unique_id = ?", loginStruct.UniqueID).First(&member).Error; err != nil ||
+		!verifyCredentials(member, loginStruct.UniqueToken, loginStruct.Nonce, loginStruct.Signature) {
+		return apierror.New(fiber.StatusUnauthorized, apierror.InvalidCredentials, "Invalid Credentials")
+	}
+
+	// Members who left have to join again, banned members can't
+	switch member.Status {
+	case database.Banned:
+		return apierror.Forbidden(apierror.Banned, "Banned")
+	case database.Left:
+		return apierror.Forbidden(apierror.NotMember, "Not a Member")
+	}
+
+	session, token, err := sessions.New(db, member.ID, loginStruct.Device)
+	if err != nil {
+		return apierror.InternalError("Error Creating Session")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message":    "Logged In",
+		"member":     member,
+		"auth_token": token,
+		"session":    session,
+	})
+}
+
+// Hands out a nonce for a member to sign and log in or rejoin with its public key.
+func LoginChallenge(c *fiber.Ctx) error {
+	challengeStruct := new(struct {
+		UniqueID string `json:"unique_id"`
+	})
+
+	if err := c.BodyParser(challengeStruct); err != nil {
+		return apierror.BadRequest("Invalid Request Body")
+	}
+
+	if challengeStruct.UniqueID == "" {
+		return apierror.Validation(apierror.Field("unique_id", "Unique ID cannot be empty"))
+	}
+
+	challenge, err := sessions.NewChallenge(database.Database, challengeStruct.UniqueID)
+	if err != nil {
+		return apierror.InternalError("Error Creating Challenge")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(challenge)
+}
+
+// A signature is checked against the member's public key, anything else
+// is taken as the unique token. Signatures are bound to the configured public
+// host, since the Host header is whatever the client says it is.
+func verifyCredentials(member database.Member, uniqueToken string, nonce string, signature string) bool {
+	if signature != "" {
+		return sessions.VerifyChallenge(database.Database, config.Host, member, nonce, signature)
+	}
+
+	return uniqueToken != "" && bcrypt.CompareHashAndPassword([]byte(member.UniqueToken), []byte(uniqueToken)) == nil
+}
+
 func LeaveServer(c *fiber.Ctx) error {
 	// Get the member from the context
 	member, err := c.Locals("Member").(database.Member)
 
 	// UnAuthorized
 	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 
 	db := database.Database
 
-	// Set the member status to left
-	if err := db.Model(&member).Update("status", "left").Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Leaving Server",
-		})
+	// Set the member status to left and sign it out everywhere
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&member).Update("status", database.Left).Error; err != nil {
+			return err
+		}
+
+		return sessions.RevokeAll(tx, member.ID)
+	}); err != nil {
+		return apierror.InternalError("Error Leaving Server")
 	}
 
+	socket.WsHub.Evict <- socket.Eviction{MemberID: member.ID, Reason: "Left"}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "Left Server",
 	})
@@ -142,25 +374,20 @@ func Me(c *fiber.Ctx) error {
 
 	// UnAuthorized
 	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 
 	if c.Method() == "GET" {
 		member.Roles = []database.Role{}
 
 		if err := database.Database.Model(&member).Association("Roles").Find(&member.Roles); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"errorCode": fiber.StatusInternalServerError,
-				"error":     "Error Finding Roles",
-			})
+			return apierror.InternalError("Error Finding Roles")
 		}
 
 		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"member":  member,
-			"isOwner": config.Owner == member.UniqueID,
+			"member":      member,
+			"isOwner":     permissions.IsOwner(member),
+			"permissions": permissions.Effective(member).List(),
 		})
 	}
 
@@ -169,10 +396,7 @@ func Me(c *fiber.Ctx) error {
 	newMember := database.Member{}
 
 	if err := c.BodyParser(&newMember); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"errorCode": fiber.StatusBadRequest,
-			"error":     "Invalid Request Body",
-		})
+		return apierror.BadRequest("Invalid Request Body")
 	}
 
 	// Update the member whatever is provided
@@ -189,10 +413,7 @@ func Me(c *fiber.Ctx) error {
 	}
 
 	if err := db.Save(&member).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Updating Member",
-		})
+		return apierror.InternalError("Error Updating Member")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
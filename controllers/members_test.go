@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/sessions"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestLoginSignatureHost(t *testing.T) {
+	db := openMembers(t)
+
+	previousDatabase, previousHost, previousLifetime := database.Database, config.Host, config.SessionLifetime
+	database.Database, config.Host, config.SessionLifetime = db, "chat.example.com:8000", time.Hour
+	t.Cleanup(func() {
+		database.Database, config.Host, config.SessionLifetime = previousDatabase, previousHost, previousLifetime
+	})
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member := database.Member{
+		UniqueID:  "member",
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+		Status:    database.Offline,
+	}
+
+	if err := db.Create(&member).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Post("/members/login", Login)
+
+	tests := []struct {
+		name       string
+		hostHeader string // The host the request names.
+		signHost   string // The host the member signed.
+		want       int
+	}{
+		// Another server relays a nonce from here and passes its own host along
+		{"relayed", "evil.example.com", "evil.example.com", fiber.StatusUnauthorized},
+		{"header ignored", "evil.example.com", "chat.example.com:8000", fiber.StatusCreated},
+		{"public host", "chat.example.com:8000", "chat.example.com:8000", fiber.StatusCreated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge, err := sessions.NewChallenge(db, member.UniqueID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signature := ed25519.Sign(privateKey, sessions.ChallengeMessage(test.signHost, member.UniqueID, challenge.Nonce))
+
+			body, err := json.Marshal(fiber.Map{
+				"unique_id": member.UniqueID,
+				"nonce":     challenge.Nonce,
+				"signature": base64.StdEncoding.EncodeToString(signature),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(fiber.MethodPost, "/members/login", strings.NewReader(string(body)))
+			req.Host = test.hostHeader
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.want {
+				t.Errorf("Login() status = %d, want %d", resp.StatusCode, test.want)
+			}
+		})
+	}
+}
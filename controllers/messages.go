@@ -1,49 +1,170 @@
 package controllers
 
 import (
-	"encoding/json"
+	"errors"
+	"eskimoe-server/apierror"
+	"eskimoe-server/commands"
 	"eskimoe-server/config"
 	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/ratelimit"
 	"eskimoe-server/socket"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
-// Gets last 25 messages from the room passed in the URL
+const (
+	defaultMessagePageSize = 25
+	maxMessagePageSize     = 100
+)
+
+// Gets a page of messages from the room passed in the URL, oldest first.
+// At most one of the before, after or around message ID cursors may be given,
+// without one the latest messages are returned. prev and next are the cursors
+// to pass as before and after for the neighbouring pages, null at either end.
 func GetMessages(c *fiber.Ctx) error {
 	_, err := c.Locals("Member").(database.Member)
 
 	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 
 	db := database.Database
 
-	roomID := c.Params("room")
-
 	var room database.Room
 
-	if err := db.Preload("Messages").Preload("Messages.Author").Preload("Messages.Reactions").Preload("Messages.Attachments").Where("id = ?", roomID).Order("created_at desc").Limit(25).Find(&room).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"errorCode": fiber.StatusNotFound,
-			"error":     "Room Not Found",
-		})
-	} else {
-		return c.Status(fiber.StatusOK).JSON(room.Messages)
+	if err := db.First(&room, c.Params("room")).Error; err != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
+	}
+
+	limit := c.QueryInt("limit", defaultMessagePageSize)
+	if limit <= 0 || limit > maxMessagePageSize {
+		return apierror.Validation(apierror.Field("limit", fmt.Sprintf("Limit must be between 1 and %d", maxMessagePageSize)))
+	}
+
+	cursors := []apierror.FieldError{}
+	for _, cursor := range []string{"before", "after", "around"} {
+		if c.Query(cursor) == "" {
+			continue
+		}
+		if c.QueryInt(cursor) <= 0 {
+			return apierror.Validation(apierror.Field(cursor, "Cursors must be message IDs"))
+		}
+		cursors = append(cursors, apierror.Field(cursor, "Only one of before, after or around can be used"))
+	}
+
+	if len(cursors) > 1 {
+		return apierror.Validation(cursors...)
+	}
+
+	page := func() *gorm.DB {
+		return db.Preload("Author").
+			Preload("Reactions.Reaction").
+			Preload("Attachments").
+			Where("room_id = ?", room.ID)
+	}
+
+	var messages []database.Message
+	var hasOlder, hasNewer bool
+	var query error
+
+	switch {
+	case c.Query("before") != "":
+		messages, hasOlder, query = olderMessages(page(), c.QueryInt("before"), limit)
+		hasNewer = query == nil && len(messages) > 0 && hasMessages(room.ID, "id > ?", messages[len(messages)-1].ID)
+	case c.Query("after") != "":
+		messages, hasNewer, query = newerMessages(page(), c.QueryInt("after")+1, limit)
+		hasOlder = query == nil && len(messages) > 0 && hasMessages(room.ID, "id < ?", messages[0].ID)
+	case c.Query("around") != "":
+		around := c.QueryInt("around")
+		var newer []database.Message
+		if messages, hasOlder, query = olderMessages(page(), around, limit/2); query == nil {
+			newer, hasNewer, query = newerMessages(page(), around, limit-limit/2)
+			messages = append(messages, newer...)
+		}
+	default:
+		messages, hasOlder, query = olderMessages(page(), 0, limit)
+	}
+
+	if query != nil {
+		return apierror.InternalError("Error Finding Messages")
+	}
+
+	response := fiber.Map{
+		"messages": messages,
+		"prev":     nil,
+		"next":     nil,
+	}
+
+	if len(messages) > 0 {
+		if hasOlder {
+			response["prev"] = messages[0].ID
+		}
+		if hasNewer {
+			response["next"] = messages[len(messages)-1].ID
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// Returns up to limit messages with an ID below before (or the latest, if before is 0)
+// oldest first, and whether there are older messages left.
+func olderMessages(page *gorm.DB, before int, limit int) ([]database.Message, bool, error) {
+	messages := []database.Message{}
+
+	if before != 0 {
+		page = page.Where("id < ?", before)
+	}
+
+	// One extra row tells us if there is more beyond this page
+	if err := page.Order("id desc").Limit(limit + 1).Find(&messages).Error; err != nil {
+		return nil, false, err
 	}
+
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+
+	slices.Reverse(messages)
+
+	return messages, more, nil
+}
+
+// Returns up to limit messages with an ID of at least from, oldest first,
+// and whether there are newer messages left.
+func newerMessages(page *gorm.DB, from int, limit int) ([]database.Message, bool, error) {
+	messages := []database.Message{}
+
+	if err := page.Where("id >= ?", from).Order("id asc").Limit(limit + 1).Find(&messages).Error; err != nil {
+		return nil, false, err
+	}
+
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+
+	return messages, more, nil
+}
+
+func hasMessages(roomID int, condition string, messageID int) bool {
+	var ids []int
+	database.Database.Model(&database.Message{}).Where("room_id = ?", roomID).Where(condition, messageID).Limit(1).Pluck("id", &ids)
+	return len(ids) > 0
 }
 
 // Send a message to the room passed in the URL
 func SendMessage(c *fiber.Ctx) error {
 	member, ok := c.Locals("Member").(database.Member)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 
 	db := database.Database
@@ -52,54 +173,199 @@ func SendMessage(c *fiber.Ctx) error {
 
 	var room database.Room
 	if err := db.First(&room, roomID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"errorCode": fiber.StatusNotFound,
-			"error":     "Room Not Found",
-		})
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
 	}
 
 	var message database.Message
 	if err := c.BodyParser(&message); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"errorCode": fiber.StatusBadRequest,
-			"error":     "Bad Request",
-		})
+		return apierror.BadRequest("Bad Request")
+	}
+
+	roomPermissions, _ := c.Locals("RoomPermissions").(permissions.Set)
+
+	switch room.Type {
+	case database.Archive:
+		return apierror.Forbidden(apierror.RoomArchived, "Archived rooms are read-only")
+	case database.Announcement:
+		if !roomPermissions.Has(database.PostAnnouncements) {
+			return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
+		}
+	}
+
+	// Only messages that made it this far count towards the slow mode
+	if err := takeSlowMode(member, room, roomPermissions); err != nil {
+		return err
+	}
+
+	if room.Type == database.Commands {
+		return runCommand(c, member, room, roomPermissions, message.Content)
 	}
 
 	db.Model(&message).Association("Author").Append(&member)
 	db.Model(&message).Association("Room").Append(&room)
 
 	if err := db.Create(&message).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Creating Message",
-		})
+		return apierror.InternalError("Error Creating Message")
 	}
 
-	broadcastData, err := json.Marshal(config.SocketBroadcast{
+	socket.WsHub.Broadcast <- socket.Envelope{RoomID: room.ID, Broadcast: config.SocketBroadcast{
 		BroadcastType: config.MessageCreated,
 		Data:          message,
+	}}
+	socket.WsHub.Activity <- socket.Activity{MemberID: member.ID}
+
+	return c.Status(fiber.StatusCreated).JSON(message)
+}
+
+var slowMode = ratelimit.NewCooldowns()
+
+// Keeps members from sending messages to the room more often than its slow
+// mode allows. Members who can manage rooms aren't slowed down.
+func takeSlowMode(member database.Member, room database.Room, roomPermissions permissions.Set) error {
+	if room.SlowMode == 0 || roomPermissions.Has(database.ManageRooms) {
+		return nil
+	}
+
+	key := fmt.Sprintf("%d:%d", room.ID, member.ID)
+
+	if allowed, wait := slowMode.Take(key, time.Duration(room.SlowMode)*time.Second); !allowed {
+		return apierror.TooManyRequests(apierror.SlowMode, "Slow Mode", wait)
+	}
+
+	return nil
+}
+
+// Runs the command sent to a commands room. Commands aren't stored or broadcast,
+// their output is only returned to the member who ran them.
+func runCommand(c *fiber.Ctx, member database.Member, room database.Room, roomPermissions permissions.Set, input string) error {
+	response, err := commands.Run(commands.Context{Member: member, Room: room, Permissions: roomPermissions}, input)
+
+	var usageError commands.UsageError
+
+	switch {
+	case err == nil:
+		socket.WsHub.Activity <- socket.Activity{MemberID: member.ID}
+		return c.Status(fiber.StatusOK).JSON(response)
+	case errors.Is(err, commands.ErrNotCommand):
+		return apierror.Validation(apierror.Field("content", "Only commands can be sent to this room"))
+	case errors.Is(err, commands.ErrUnknownCommand):
+		return apierror.NotFound(apierror.CommandNotFound, "Unknown Command")
+	case errors.Is(err, commands.ErrMissingPermission):
+		return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
+	case errors.As(err, &usageError):
+		return apierror.Validation(apierror.Field("content", usageError.Error()))
+	default:
+		return apierror.InternalError("Error Running Command")
+	}
+}
+
+// Edits a message, only its author can change the content.
+// The previous content is kept as a revision.
+func EditMessage(c *fiber.Ctx) error {
+	editor, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var message database.Message
+
+	if err := db.Preload("Author").Preload("Room").Where("id = ? AND room_id = ?", c.Params("message"), c.Params("room")).First(&message).Error; err != nil {
+		return apierror.NotFound(apierror.MessageNotFound, "Message Not Found")
+	}
+
+	if message.Room.Type == database.Archive {
+		return apierror.Forbidden(apierror.RoomArchived, "Archived rooms are read-only")
+	}
+
+	if message.AuthorID != editor.ID {
+		return apierror.Forbidden(apierror.NotAuthor, "Only the author can edit a message")
+	}
+
+	// Editing is sending again, so it takes what sending to the room takes now
+	roomPermissions, _ := c.Locals("RoomPermissions").(permissions.Set)
+
+	if !roomPermissions.Has(database.SendMessage) ||
+		(message.Room.Type == database.Announcement && !roomPermissions.Has(database.PostAnnouncements)) {
+		return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
+	}
+
+	messageEditStruct := new(struct {
+		Content string `json:"content"`
 	})
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Encoding Message",
-		})
+
+	if err := c.BodyParser(messageEditStruct); err != nil {
+		return apierror.BadRequest("Invalid Request Body")
 	}
 
-	socket.WsHub.Broadcast <- broadcastData
+	if strings.TrimSpace(messageEditStruct.Content) == "" {
+		return apierror.Validation(apierror.Field("content", "Content cannot be empty"))
+	}
 
-	return c.Status(fiber.StatusCreated).JSON(message)
+	if messageEditStruct.Content == message.Content {
+		return c.Status(fiber.StatusOK).JSON(message)
+	}
+
+	revision := database.MessageRevision{
+		Content:   message.Content,
+		MessageID: message.ID,
+	}
+
+	message.Content = messageEditStruct.Content
+	message.Edited = true
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&message).Updates(map[string]interface{}{
+			"content": message.Content,
+			"edited":  true,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Editing Message")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{RoomID: message.RoomID, Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MessageEdited,
+		Data:          message,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(message)
+}
+
+// Gets every earlier version of a message, oldest first. Moderators only.
+func MessageRevisions(c *fiber.Ctx) error {
+	_, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var message database.Message
+
+	if err := db.Preload("Author").Preload("Revisions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	}).Where("id = ? AND room_id = ?", c.Params("message"), c.Params("room")).First(&message).Error; err != nil {
+		return apierror.NotFound(apierror.MessageNotFound, "Message Not Found")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":   message,
+		"revisions": message.Revisions,
+	})
 }
 
 func DeleteMessage(c *fiber.Ctx) error {
 	deleter, err := c.Locals("Member").(database.Member)
 
 	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 
 	db := database.Database
@@ -109,44 +375,55 @@ func DeleteMessage(c *fiber.Ctx) error {
 
 	var message database.Message
 
-	if err := db.Preload("Author").Where("id = ? AND room_id = ?", messageID, roomID).First(&message).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"errorCode": fiber.StatusNotFound,
-			"error":     "Message Not Found",
-		})
+	if err := db.Preload("Author").Preload("Room").Where("id = ? AND room_id = ?", messageID, roomID).First(&message).Error; err != nil {
+		return apierror.NotFound(apierror.MessageNotFound, "Message Not Found")
+	}
+
+	if message.Room.Type == database.Archive {
+		return apierror.Forbidden(apierror.RoomArchived, "Archived rooms are read-only")
 	}
 
-	// Must be the author, owner, or admin to delete a message
-	hasDeletePermission := message.Author.ID == deleter.ID
+	// Must be the author, or hold the permission to delete anyone's message in the room
+	roomPermissions, _ := c.Locals("RoomPermissions").(permissions.Set)
+	hasDeletePermission := message.Author.ID == deleter.ID || roomPermissions.Has(database.DeleteMessage)
 
 	if !hasDeletePermission {
-		if config.Owner == deleter.UniqueID {
-			hasDeletePermission = true
-		} else {
-			for _, role := range deleter.Roles {
-				permissions := role.Permissions
-				for _, permission := range permissions {
-					if permission == database.DeleteMessage {
-						hasDeletePermission = true
-						break
-					}
-				}
-			}
-		}
+		return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
 	}
 
-	if !hasDeletePermission {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("message_id = ?", message.ID).Delete(&database.MessageRevision{}).Error; err != nil {
+			return err
+		}
+
+		if err := deleteMessageReactions(tx, "message_id = ?", message.ID); err != nil {
+			return err
+		}
+
+		return tx.Delete(&message).Error
+	}); err != nil {
+		return apierror.InternalError("Error Deleting Message")
 	}
 
-	if err := db.Delete(&message).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Deleting Message",
-		})
+	// Deleting someone else's message is a moderation action, log it for the moderators
+	if message.Author.ID != deleter.ID {
+		serverLog := database.Log{
+			Type:     database.MessageDeleted,
+			Content:  fmt.Sprintf("Message %d by %s deleted from Room %d", message.ID, message.Author.DisplayName, message.RoomID),
+			MemberID: deleter.ID,
+			ServerID: deleter.ServerID,
+		}
+
+		if err := db.Create(&serverLog).Error; err != nil {
+			return apierror.InternalError("Error Creating Log")
+		}
+
+		serverLog.Member = deleter
+
+		socket.WsHub.Broadcast <- socket.Envelope{Permission: database.ViewLogs, Broadcast: config.SocketBroadcast{
+			BroadcastType: config.LogCreated,
+			Data:          serverLog,
+		}}
 	}
 
 	deletedData := struct {
@@ -159,12 +436,10 @@ func DeleteMessage(c *fiber.Ctx) error {
 		Deleted:   true,
 	}
 
-	broadcastData, _ := json.Marshal(config.SocketBroadcast{
+	socket.WsHub.Broadcast <- socket.Envelope{RoomID: message.RoomID, Broadcast: config.SocketBroadcast{
 		BroadcastType: config.MessageDeleted,
 		Data:          deletedData,
-	})
-
-	socket.WsHub.Broadcast <- broadcastData
+	}}
 
 	return c.Status(fiber.StatusOK).JSON(deletedData)
 }
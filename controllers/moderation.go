@@ -0,0 +1,377 @@
+package controllers
+
+import (
+	"errors"
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/sessions"
+	"eskimoe-server/socket"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Moderators can only act on members below their own highest role.
+// Kicked members can join again, banned ones only once their ban expires or is lifted.
+// Mutes are lifted by the mute worker once they run out.
+
+// Removes the member passed in the URL from the server.
+func KickMember(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	kickStruct := new(struct {
+		Reason string `json:"reason"`
+	})
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(kickStruct); err != nil {
+			return apierror.BadRequest("Invalid Request")
+		}
+	}
+
+	var target database.Member
+
+	if err := database.Database.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if target, err = findModerationTarget(tx, c, member); err != nil {
+			return err
+		}
+
+		if err := removeMember(tx, target, database.Left); err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.MemberKicked,
+			Content:  withReason(fmt.Sprintf("%s kicked by %s", target.DisplayName, member.DisplayName), kickStruct.Reason),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return moderationError(err, "Error Kicking Member")
+	}
+
+	target.Status = database.Left
+
+	socket.WsHub.Evict <- socket.Eviction{MemberID: target.ID, Reason: "Kicked"}
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberKicked,
+		Data: fiber.Map{
+			"member": target,
+			"reason": kickStruct.Reason,
+		},
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Member Kicked",
+	})
+}
+
+// Bans the member passed in the URL. Bans last for duration seconds,
+// or until they are lifted if no duration is given.
+func BanMember(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	banStruct := new(struct {
+		Reason   string `json:"reason"`
+		Duration int    `json:"duration"`
+	})
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(banStruct); err != nil {
+			return apierror.BadRequest("Invalid Request")
+		}
+	}
+
+	if banStruct.Duration < 0 {
+		return apierror.Validation(apierror.Field("duration", "Ban duration cannot be negative"))
+	}
+
+	ban := database.Ban{
+		Reason:     banStruct.Reason,
+		BannedByID: member.ID,
+		ServerID:   member.ServerID,
+	}
+
+	until := ""
+
+	if banStruct.Duration > 0 {
+		expiresAt := time.Now().Add(time.Duration(banStruct.Duration) * time.Second)
+		ban.ExpiresAt = &expiresAt
+		until = fmt.Sprintf(" until %s", expiresAt.UTC().Format(time.RFC3339))
+	}
+
+	if err := database.Database.Transaction(func(tx *gorm.DB) error {
+		target, err := findModerationTarget(tx, c, member)
+		if err != nil {
+			return err
+		}
+
+		if err := removeMember(tx, target, database.Banned); err != nil {
+			return err
+		}
+
+		// A member only ever has one ban, an expired one may still be around
+		if err := tx.Where("member_id = ?", target.ID).Delete(&database.Ban{}).Error; err != nil {
+			return err
+		}
+
+		ban.MemberID = target.ID
+
+		if err := tx.Create(&ban).Error; err != nil {
+			return err
+		}
+
+		target.Status = database.Banned
+		target.Roles = nil
+		ban.Member = target
+
+		member.Roles = nil
+		ban.BannedBy = member
+
+		return tx.Create(&database.Log{
+			Type:     database.MemberBanned,
+			Content:  withReason(fmt.Sprintf("%s banned by %s%s", target.DisplayName, member.DisplayName, until), banStruct.Reason),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return moderationError(err, "Error Banning Member")
+	}
+
+	socket.WsHub.Evict <- socket.Eviction{MemberID: ban.MemberID, Reason: "Banned"}
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberBanned,
+		Data:          ban,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(ban)
+}
+
+// Lifts the ban of the member passed in the URL, who can then join again.
+func UnbanMember(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	var target database.Member
+
+	if err := database.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("unique_id = ? AND status = ?", c.Params("member"), database.Banned).First(&target).Error; err != nil {
+			return errMemberNotBanned
+		}
+
+		if err := tx.Where("member_id = ?", target.ID).Delete(&database.Ban{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&target).Update("status", database.Left).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.MemberUnbanned,
+			Content:  fmt.Sprintf("%s unbanned by %s", target.DisplayName, member.DisplayName),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return moderationError(err, "Error Unbanning Member")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberUnbanned,
+		Data:          target,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Member Unbanned",
+	})
+}
+
+// Times out the member passed in the URL for duration seconds. Muted members
+// can't send messages, react or type until the mute is over.
+func MuteMember(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	muteStruct := new(struct {
+		Reason   string `json:"reason"`
+		Duration int    `json:"duration"`
+	})
+
+	if err := c.BodyParser(muteStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if muteStruct.Duration <= 0 {
+		return apierror.Validation(apierror.Field("duration", "Mute duration must be positive"))
+	}
+
+	mutedUntil := time.Now().Add(time.Duration(muteStruct.Duration) * time.Second)
+
+	var target database.Member
+
+	if err := database.Database.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if target, err = findModerationTarget(tx, c, member); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&target).Update("muted_until", mutedUntil).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.MemberUpdated,
+			Content:  withReason(fmt.Sprintf("%s muted by %s until %s", target.DisplayName, member.DisplayName, mutedUntil.UTC().Format(time.RFC3339)), muteStruct.Reason),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return moderationError(err, "Error Muting Member")
+	}
+
+	target.MutedUntil = &mutedUntil
+
+	socket.WsHub.Refresh <- []int{target.ID}
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberUpdated,
+		Data:          target,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(target)
+}
+
+// Ends the mute of the member passed in the URL early.
+func UnmuteMember(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	var target database.Member
+
+	if err := database.Database.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if target, err = findModerationTarget(tx, c, member); err != nil {
+			return err
+		}
+
+		if !target.Muted() {
+			return errMemberNotMuted
+		}
+
+		if err := tx.Model(&target).Update("muted_until", nil).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.MemberUpdated,
+			Content:  fmt.Sprintf("%s unmuted by %s", target.DisplayName, member.DisplayName),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return moderationError(err, "Error Unmuting Member")
+	}
+
+	target.MutedUntil = nil
+
+	socket.WsHub.Refresh <- []int{target.ID}
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberUpdated,
+		Data:          target,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(target)
+}
+
+// Finds the member passed in the URL, who must be below the moderator's highest role.
+func findModerationTarget(tx *gorm.DB, c *fiber.Ctx, member database.Member) (database.Member, error) {
+	var target database.Member
+
+	if err := tx.Preload("Roles").Where("unique_id = ? AND status NOT IN ?", c.Params("member"), database.DepartedStatuses).First(&target).Error; err != nil {
+		return target, errMemberNotFound
+	}
+
+	var server database.Server
+
+	if err := tx.First(&server, member.ServerID).Error; err != nil {
+		return target, err
+	}
+
+	if permissions.HighestRolePosition(member, server.RoleOrder) >= permissions.HighestRolePosition(target, server.RoleOrder) {
+		return target, errRoleHierarchy
+	}
+
+	return target, nil
+}
+
+// Sets the status of a member that is being removed from the server and signs
+// it out everywhere, unless someone else removed it first.
+func removeMember(tx *gorm.DB, target database.Member, status database.MemberStatus) error {
+	result := tx.Model(&database.Member{}).
+		Where("id = ? AND status NOT IN ?", target.ID, database.DepartedStatuses).
+		Update("status", status)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errMemberNotFound
+	}
+
+	// Roles are handed out again, not kept for whenever the member comes back
+	if err := tx.Model(&database.Member{ID: target.ID}).Association("Roles").Clear(); err != nil {
+		return err
+	}
+
+	return sessions.RevokeAll(tx, target.ID)
+}
+
+func withReason(content string, reason string) string {
+	if reason == "" {
+		return content
+	}
+
+	return fmt.Sprintf("%s: %s", content, reason)
+}
+
+var errMemberNotFound = errors.New("member not found")
+var errMemberNotBanned = errors.New("member is not banned")
+var errMemberNotMuted = errors.New("member is not muted")
+
+func moderationError(err error, message string) error {
+	switch {
+	case errors.Is(err, errMemberNotFound):
+		return apierror.NotFound(apierror.MemberNotFound, "Member Not Found")
+	case errors.Is(err, errMemberNotBanned):
+		return apierror.NotFound(apierror.BanNotFound, "Ban Not Found")
+	case errors.Is(err, errMemberNotMuted):
+		return apierror.Conflict(apierror.MemberNotMuted, "Member is not muted")
+	case errors.Is(err, errRoleHierarchy):
+		return apierror.Forbidden(apierror.RoleHierarchy, "Members can only be moderated below your highest role")
+	default:
+		return apierror.InternalError(message)
+	}
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"eskimoe-server/database"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Opens an empty in-memory database with room for members, their roles and
+// what they sign in with.
+func openMembers(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection to an in-memory database gets a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&database.Role{}, &database.Member{}, &database.Session{}, &database.Challenge{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestRemoveMemberClearsRoles(t *testing.T) {
+	for _, status := range []database.MemberStatus{database.Left, database.Banned} {
+		t.Run(string(status), func(t *testing.T) {
+			db := openMembers(t)
+
+			member := database.Member{
+				UniqueID: "member",
+				Status:   database.Online,
+				Roles:    []database.Role{{Name: "everyone"}, {Name: "moderator"}},
+			}
+
+			if err := db.Create(&member).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			if err := removeMember(db, member, status); err != nil {
+				t.Fatal(err)
+			}
+
+			if count := db.Model(&database.Member{ID: member.ID}).Association("Roles").Count(); count != 0 {
+				t.Errorf("member kept %d roles after being removed", count)
+			}
+
+			var roles int64
+			db.Model(&database.Role{}).Count(&roles)
+
+			if roles != 2 {
+				t.Errorf("removing a member deleted roles, %d left", roles)
+			}
+		})
+	}
+}
+
+func TestRemoveMemberDeparted(t *testing.T) {
+	db := openMembers(t)
+
+	member := database.Member{UniqueID: "member", Status: database.Left}
+
+	if err := db.Create(&member).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeMember(db, member, database.Banned); err != errMemberNotFound {
+		t.Errorf("removeMember() = %v, want %v", err, errMemberNotFound)
+	}
+}
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"errors"
+	"eskimoe-server/apierror"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/socket"
+	"fmt"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Overwrites allow or deny permissions in a single room for a role or a member.
+// Like roles, members can only set overwrites for roles and members below
+// their own highest role, and only for permissions they have themselves.
+
+// Returns the overwrites of the room passed in the URL.
+func RoomOverwrites(c *fiber.Ctx) error {
+	db := database.Database
+
+	var room database.Room
+
+	roomID, err := c.ParamsInt("room")
+
+	if err != nil || db.First(&room, roomID).Error != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
+	}
+
+	overwrites := []database.RoomOverwrite{}
+
+	if err := db.Preload("Member").Where("room_id = ?", room.ID).Order("id asc").Find(&overwrites).Error; err != nil {
+		return apierror.InternalError("Error Finding Overwrites")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(overwrites)
+}
+
+// Sets what the role passed in the URL is allowed and denied in the room.
+func UpdateRoleOverwrite(c *fiber.Ctx) error {
+	return updateOverwrite(c, true)
+}
+
+// Sets what the member passed in the URL is allowed and denied in the room.
+func UpdateMemberOverwrite(c *fiber.Ctx) error {
+	return updateOverwrite(c, false)
+}
+
+// Removes the role's overwrite from the room, leaving it with its server-wide permissions.
+func DeleteRoleOverwrite(c *fiber.Ctx) error {
+	return deleteOverwrite(c, true)
+}
+
+// Removes the member's overwrite from the room, leaving it with its server-wide permissions.
+func DeleteMemberOverwrite(c *fiber.Ctx) error {
+	return deleteOverwrite(c, false)
+}
+
+func updateOverwrite(c *fiber.Ctx, byRole bool) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var room database.Room
+
+	roomID, err := c.ParamsInt("room")
+
+	if err != nil || db.First(&room, roomID).Error != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
+	}
+
+	overwriteUpdateStruct := new(struct {
+		Allow []database.Permission `json:"allow"`
+		Deny  []database.Permission `json:"deny"`
+	})
+
+	if err := c.BodyParser(overwriteUpdateStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if err := validateOverwritePermissions(member, overwriteUpdateStruct.Allow, overwriteUpdateStruct.Deny); err != nil {
+		return err
+	}
+
+	var overwrite database.RoomOverwrite
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		target, err := findOverwriteTarget(tx, c, member, byRole)
+		if err != nil {
+			return err
+		}
+
+		if err := target.scope(tx.Where("room_id = ?", room.ID)).First(&overwrite).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			overwrite = database.RoomOverwrite{RoomID: room.ID, RoleID: target.RoleID, MemberID: target.MemberID}
+		}
+
+		overwrite.Allow = append([]database.Permission{}, overwriteUpdateStruct.Allow...)
+		overwrite.Deny = append([]database.Permission{}, overwriteUpdateStruct.Deny...)
+
+		if err := tx.Save(&overwrite).Error; err != nil {
+			return err
+		}
+
+		overwrite.Member = target.Member
+
+		return tx.Create(&database.Log{
+			Type:     database.RoomUpdated,
+			Content:  fmt.Sprintf("Permissions for %s in Room %s updated", target.Name, room.Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return overwriteError(err, byRole, "Error Updating Overwrite")
+	}
+
+	socket.WsHub.Overwrites <- room.ID
+	broadcastOverwriteUpdate(room)
+
+	return c.Status(fiber.StatusOK).JSON(overwrite)
+}
+
+func deleteOverwrite(c *fiber.Ctx, byRole bool) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var room database.Room
+
+	roomID, err := c.ParamsInt("room")
+
+	if err != nil || db.First(&room, roomID).Error != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		target, err := findOverwriteTarget(tx, c, member, byRole)
+		if err != nil {
+			return err
+		}
+
+		result := target.scope(tx.Where("room_id = ?", room.ID)).Delete(&database.RoomOverwrite{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return errOverwriteNotFound
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.RoomUpdated,
+			Content:  fmt.Sprintf("Permissions for %s in Room %s reset", target.Name, room.Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return overwriteError(err, byRole, "Error Deleting Overwrite")
+	}
+
+	socket.WsHub.Overwrites <- room.ID
+	broadcastOverwriteUpdate(room)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Overwrite Deleted",
+	})
+}
+
+// The role or member an overwrite is for.
+type overwriteTarget struct {
+	RoleID   *int
+	MemberID *int
+	Member   *database.Member
+	Name     string
+}
+
+func (t overwriteTarget) scope(tx *gorm.DB) *gorm.DB {
+	if t.RoleID != nil {
+		return tx.Where("role_id = ?", *t.RoleID)
+	}
+
+	return tx.Where("member_id = ?", *t.MemberID)
+}
+
+// Finds the role or member passed in the URL, which must be below the member's highest role.
+func findOverwriteTarget(tx *gorm.DB, c *fiber.Ctx, member database.Member, byRole bool) (overwriteTarget, error) {
+	var server database.Server
+
+	if err := tx.First(&server, member.ServerID).Error; err != nil {
+		return overwriteTarget{}, err
+	}
+
+	if byRole {
+		var role database.Role
+
+		roleID, err := c.ParamsInt("role")
+
+		if err != nil || tx.First(&role, roleID).Error != nil {
+			return overwriteTarget{}, errOverwriteTarget
+		}
+
+		if !permissions.CanManageRole(member, server.RoleOrder, role.ID) {
+			return overwriteTarget{}, errRoleHierarchy
+		}
+
+		return overwriteTarget{RoleID: &role.ID, Name: "role " + role.Name}, nil
+	}
+
+	var target database.Member
+
+	if err := tx.Preload("Roles").Where("unique_id = ? AND status NOT IN ?", c.Params("member"), database.DepartedStatuses).First(&target).Error; err != nil {
+		return overwriteTarget{}, errOverwriteTarget
+	}
+
+	if permissions.HighestRolePosition(member, server.RoleOrder) >= permissions.HighestRolePosition(target, server.RoleOrder) {
+		return overwriteTarget{}, errRoleHierarchy
+	}
+
+	return overwriteTarget{MemberID: &target.ID, Member: &target, Name: target.DisplayName}, nil
+}
+
+// Permissions must be known and can't be both allowed and denied. Administrator
+// can't be overwritten, and members can only allow or deny what they have themselves.
+func validateOverwritePermissions(member database.Member, allow []database.Permission, deny []database.Permission) error {
+	if err := validateOverwriteList(member, "allow", allow); err != nil {
+		return err
+	}
+
+	if err := validateOverwriteList(member, "deny", deny); err != nil {
+		return err
+	}
+
+	for _, permission := range allow {
+		if slices.Contains(deny, permission) {
+			return apierror.Validation(apierror.Field("deny", fmt.Sprintf("Cannot both allow and deny %s", permission)))
+		}
+	}
+
+	return nil
+}
+
+func validateOverwriteList(member database.Member, field string, list []database.Permission) error {
+	for _, permission := range list {
+		if !slices.Contains(database.Permissions, permission) {
+			return apierror.Validation(apierror.Field(field, fmt.Sprintf("Unknown Permission %s", permission)))
+		}
+
+		if permission == database.Administrator {
+			return apierror.Validation(apierror.Field(field, "Administrator cannot be overwritten in a room"))
+		}
+
+		if !permissions.Has(member, permission) {
+			return apierror.Forbidden(apierror.MissingPermission, fmt.Sprintf("Cannot overwrite %s without having it", permission))
+		}
+	}
+
+	return nil
+}
+
+var errOverwriteTarget = errors.New("overwrite target not found")
+var errOverwriteNotFound = errors.New("overwrite not found")
+
+func overwriteError(err error, byRole bool, message string) error {
+	switch {
+	case errors.Is(err, errOverwriteTarget):
+		if byRole {
+			return apierror.NotFound(apierror.RoleNotFound, "Role Not Found")
+		}
+		return apierror.NotFound(apierror.MemberNotFound, "Member Not Found")
+	case errors.Is(err, errOverwriteNotFound):
+		return apierror.NotFound(apierror.OverwriteNotFound, "Overwrite Not Found")
+	case errors.Is(err, errRoleHierarchy):
+		return apierror.Forbidden(apierror.RoleHierarchy, "Overwrites can only be set below your highest role")
+	default:
+		return apierror.InternalError(message)
+	}
+}
+
+// Tells everyone who can see the room about the change. Its category goes out
+// as well, so the room shows up for members who can now see it and disappears
+// for those who no longer can.
+func broadcastOverwriteUpdate(room database.Room) {
+	var category database.Category
+
+	if err := database.Database.Preload("Rooms").First(&category, room.CategoryID).Error; err != nil {
+		broadcastRoomUpdate(room, nil)
+		return
+	}
+
+	broadcastRoomUpdate(room, []database.Category{category})
+}
@@ -0,0 +1,405 @@
+package controllers
+
+import (
+	"errors"
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/socket"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type reactionChange struct {
+	MessageID int                     `json:"message_id"`
+	RoomID    int                     `json:"room_id"`
+	Reaction  database.ServerReaction `json:"reaction"`
+	Count     int                     `json:"count"`
+	Member    database.Member         `json:"member"`
+}
+
+// Adds the member's reaction to the message passed in the URL.
+// Reactions are referred to by name, and reacting twice is a no-op.
+func AddReaction(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	return toggleReaction(c, member, true)
+}
+
+// Removes the member's reaction from the message passed in the URL.
+func RemoveReaction(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	return toggleReaction(c, member, false)
+}
+
+func toggleReaction(c *fiber.Ctx, member database.Member, add bool) error {
+	db := database.Database
+
+	var message database.Message
+
+	if err := db.Preload("Room").Where("id = ? AND room_id = ?", c.Params("message"), c.Params("room")).First(&message).Error; err != nil {
+		return apierror.NotFound(apierror.MessageNotFound, "Message Not Found")
+	}
+
+	if message.Room.Type == database.Archive {
+		return apierror.Forbidden(apierror.RoomArchived, "Archived rooms are read-only")
+	}
+
+	var serverReaction database.ServerReaction
+
+	if err := db.Where("reaction = ?", strings.ToUpper(c.Params("reaction"))).First(&serverReaction).Error; err != nil {
+		return apierror.NotFound(apierror.ReactionNotFound, "Reaction Not Found")
+	}
+
+	var broadcastType config.BroadcastType
+	changed := false
+
+	// Only the member itself is associated, never its roles
+	member.Roles = nil
+
+	messageReaction := database.MessageReaction{
+		MessageID:  message.ID,
+		ReactionID: serverReaction.ID,
+	}
+
+	// The count is always recounted from the members who reacted, so concurrent
+	// toggles can never leave it out of step with the association.
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		created := false
+
+		if add {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&messageReaction)
+			if result.Error != nil {
+				return result.Error
+			}
+			created = result.RowsAffected == 1
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("message_id = ? AND reaction_id = ?", message.ID, serverReaction.ID).
+			First(&messageReaction).Error; err != nil {
+			// Nobody reacted with it, so there is nothing to remove
+			if !add && errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		var reacted int64
+		if err := tx.Table("message_reaction_members").
+			Where("message_reaction_id = ? AND member_id = ?", messageReaction.ID, member.ID).
+			Count(&reacted).Error; err != nil {
+			return err
+		}
+
+		switch {
+		case add && reacted == 0:
+			if err := tx.Model(&messageReaction).Association("Members").Append(&member); err != nil {
+				return err
+			}
+		case !add && reacted > 0:
+			if err := tx.Model(&messageReaction).Association("Members").Delete(&member); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		changed = true
+		messageReaction.Count = int(tx.Model(&messageReaction).Association("Members").Count())
+
+		switch {
+		case messageReaction.Count == 0:
+			broadcastType = config.MessageReactionDeleted
+			return tx.Delete(&messageReaction).Error
+		case created:
+			broadcastType = config.MessageReactionCreated
+		default:
+			broadcastType = config.MessageReactionUpdated
+		}
+
+		return tx.Model(&messageReaction).Update("count", messageReaction.Count).Error
+	}); err != nil {
+		return apierror.InternalError("Error Updating Reaction")
+	}
+
+	change := reactionChange{
+		MessageID: message.ID,
+		RoomID:    message.RoomID,
+		Reaction:  serverReaction,
+		Count:     messageReaction.Count,
+		Member:    member,
+	}
+
+	if changed {
+		socket.WsHub.Broadcast <- socket.Envelope{RoomID: message.RoomID, Broadcast: config.SocketBroadcast{
+			BroadcastType: broadcastType,
+			Data:          change,
+		}}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(change)
+}
+
+// Removes message reactions matching the query along with the record of who reacted.
+func deleteMessageReactions(tx *gorm.DB, query string, args ...interface{}) error {
+	var ids []int
+
+	if err := tx.Model(&database.MessageReaction{}).Where(query, args...).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := tx.Exec("DELETE FROM message_reaction_members WHERE message_reaction_id IN ?", ids).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("id IN ?", ids).Delete(&database.MessageReaction{}).Error
+}
+
+var reactionNamePattern = regexp.MustCompile(`^[A-Z0-9_]{1,32}$`)
+var reactionColorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// Reaction names are stored upper case, so "like" and "LIKE" are the same reaction.
+func validateServerReaction(name string, color string) error {
+	fields := []apierror.FieldError{}
+
+	if !reactionNamePattern.MatchString(name) {
+		fields = append(fields, apierror.Field("reaction", "Reaction names must be 1 to 32 letters, digits or underscores"))
+	}
+
+	if color != "" && !reactionColorPattern.MatchString(color) {
+		fields = append(fields, apierror.Field("color", "Reaction colors must be hex colors like #FF8800"))
+	}
+
+	if len(fields) > 0 {
+		return apierror.Validation(fields...)
+	}
+
+	return nil
+}
+
+// Reaction names are unique, so a name taken in the meantime is a conflict.
+func serverReactionError(err error, message string) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return apierror.Conflict(apierror.ReactionExists, "Reaction already exists")
+	}
+
+	return apierror.InternalError(message)
+}
+
+func ServerReactions(c *fiber.Ctx) error {
+	_, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	var serverReactions []database.ServerReaction
+
+	if err := database.Database.Order("id asc").Find(&serverReactions).Error; err != nil {
+		return apierror.InternalError("Error Finding Reactions")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(serverReactions)
+}
+
+func CreateServerReaction(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	reactionCreationStruct := new(struct {
+		Reaction string `json:"reaction"`
+		Color    string `json:"color"`
+	})
+
+	if err := c.BodyParser(reactionCreationStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	name := strings.ToUpper(strings.TrimSpace(reactionCreationStruct.Reaction))
+
+	if err := validateServerReaction(name, reactionCreationStruct.Color); err != nil {
+		return err
+	}
+
+	db := database.Database
+
+	newReaction := database.ServerReaction{
+		Reaction: name,
+		Color:    reactionCreationStruct.Color,
+		ServerID: member.ServerID,
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newReaction).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.ReactionCreated,
+			Content:  fmt.Sprintf("Reaction %s created", newReaction.Reaction),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return serverReactionError(err, "Error Creating Reaction")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.ServerReactionCreated,
+		Data:          newReaction,
+	}}
+
+	return c.Status(fiber.StatusCreated).JSON(newReaction)
+}
+
+func UpdateServerReaction(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var serverReaction database.ServerReaction
+
+	if err := db.Where("reaction = ?", strings.ToUpper(c.Params("reaction"))).First(&serverReaction).Error; err != nil {
+		return apierror.NotFound(apierror.ReactionNotFound, "Reaction Not Found")
+	}
+
+	reactionUpdateStruct := new(struct {
+		Reaction string `json:"reaction"`
+		Color    string `json:"color"`
+	})
+
+	if err := c.BodyParser(reactionUpdateStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	var changes []string
+
+	name := strings.ToUpper(strings.TrimSpace(reactionUpdateStruct.Reaction))
+	if name == "" {
+		name = serverReaction.Reaction
+	}
+
+	color := reactionUpdateStruct.Color
+	if color == "" {
+		color = serverReaction.Color
+	}
+
+	if err := validateServerReaction(name, color); err != nil {
+		return err
+	}
+
+	if name != serverReaction.Reaction {
+		changes = append(changes, fmt.Sprintf("Reaction: %s", name))
+	}
+
+	if color != serverReaction.Color {
+		changes = append(changes, fmt.Sprintf("Color: %s", color))
+	}
+
+	// Update the Server Log on changes
+	if len(changes) == 0 {
+		return c.Status(fiber.StatusOK).JSON(serverReaction)
+	}
+
+	previousName := serverReaction.Reaction
+	serverReaction.Reaction = name
+	serverReaction.Color = color
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&serverReaction).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.ReactionUpdated,
+			Content:  fmt.Sprintf("Reaction %s updated.\n%s", previousName, strings.Join(changes, "\n")),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return serverReactionError(err, "Error Updating Reaction")
+	}
+
+	// Reactions are known by name, so renaming one says what it was called before
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.ServerReactionUpdated,
+		Data: struct {
+			database.ServerReaction
+			PreviousReaction string `json:"previous_reaction"`
+		}{serverReaction, previousName},
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(serverReaction)
+}
+
+// Deletes a reaction from the server, and every use of it on messages.
+func DeleteServerReaction(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var serverReaction database.ServerReaction
+
+	if err := db.Where("reaction = ?", strings.ToUpper(c.Params("reaction"))).First(&serverReaction).Error; err != nil {
+		return apierror.NotFound(apierror.ReactionNotFound, "Reaction Not Found")
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := deleteMessageReactions(tx, "reaction_id = ?", serverReaction.ID); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&serverReaction).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.ReactionDeleted,
+			Content:  fmt.Sprintf("Reaction %s deleted", serverReaction.Reaction),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Deleting Reaction")
+	}
+
+	// Clients drop the reaction from every message they have
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.ServerReactionDeleted,
+		Data:          serverReaction,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Reaction Deleted",
+	})
+}
@@ -0,0 +1,495 @@
+package controllers
+
+import (
+	"errors"
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/socket"
+	"eskimoe-server/utils"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Roles are ordered from the highest to the lowest in Server.RoleOrder, with
+// the everyone role always last. Members can only create, edit, delete, assign
+// and unassign roles below their own highest role, and can only grant
+// permissions they have themselves. The owner is above every role.
+
+// Returns the roles of the server from the highest to the lowest.
+func Roles(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var server database.Server
+
+	if err := db.Preload("Roles").First(&server, member.ServerID).Error; err != nil {
+		return apierror.InternalError("Error Finding Roles")
+	}
+
+	slices.SortStableFunc(server.Roles, func(a, b database.Role) int {
+		return permissions.RolePosition(server.RoleOrder, a.ID) - permissions.RolePosition(server.RoleOrder, b.ID)
+	})
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"roles":      server.Roles,
+		"role_order": server.RoleOrder,
+	})
+}
+
+func CreateRole(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	roleCreationStruct := new(struct {
+		Name        string                `json:"name"`
+		Permissions []database.Permission `json:"permissions"`
+		Position    *int                  `json:"position"`
+	})
+
+	if err := c.BodyParser(roleCreationStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	name := strings.TrimSpace(roleCreationStruct.Name)
+
+	if name == "" {
+		return apierror.Validation(apierror.Field("name", "Role name cannot be empty"))
+	}
+
+	if err := validateRolePermissions(member, roleCreationStruct.Permissions); err != nil {
+		return err
+	}
+
+	db := database.Database
+
+	newRole := database.Role{
+		Name:        name,
+		Permissions: uniquePermissions(roleCreationStruct.Permissions),
+		ServerID:    member.ServerID,
+	}
+
+	var server database.Server
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&server, member.ServerID).Error; err != nil {
+			return err
+		}
+
+		// New roles go right above the everyone role unless told otherwise
+		position := len(server.RoleOrder) - 1
+		if roleCreationStruct.Position != nil {
+			position = *roleCreationStruct.Position
+		}
+
+		if !validRolePosition(member, server.RoleOrder, position, 0) {
+			return errRolePosition
+		}
+
+		if err := tx.Create(&newRole).Error; err != nil {
+			return err
+		}
+
+		server.RoleOrder = utils.InsertID(server.RoleOrder, newRole.ID, position)
+
+		if err := tx.Model(&server).Update("role_order", server.RoleOrder).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.RoleCreated,
+			Content:  fmt.Sprintf("Role %s created", newRole.Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return roleError(err, "Error Creating Role")
+	}
+
+	broadcastRoleChange(config.RoleCreated, newRole, server.RoleOrder)
+
+	return c.Status(fiber.StatusCreated).JSON(newRole)
+}
+
+func UpdateRole(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	roleUpdateStruct := new(struct {
+		Name        string                `json:"name"`
+		Permissions []database.Permission `json:"permissions"`
+		Position    *int                  `json:"position"`
+	})
+
+	if err := c.BodyParser(roleUpdateStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	db := database.Database
+
+	var role database.Role
+
+	roleID, err := c.ParamsInt("role")
+
+	if err != nil || db.First(&role, roleID).Error != nil {
+		return apierror.NotFound(apierror.RoleNotFound, "Role Not Found")
+	}
+
+	name := strings.TrimSpace(roleUpdateStruct.Name)
+
+	// System roles keep their name and place, only their permissions can change
+	if role.SystemRole && ((name != "" && name != role.Name) || roleUpdateStruct.Position != nil) {
+		return apierror.Forbidden(apierror.SystemRole, "System roles can only have their permissions changed")
+	}
+
+	if roleUpdateStruct.Permissions != nil {
+		if err := validateRolePermissions(member, roleUpdateStruct.Permissions); err != nil {
+			return err
+		}
+
+		roleUpdateStruct.Permissions = uniquePermissions(roleUpdateStruct.Permissions)
+	}
+
+	var changes []string
+	var server database.Server
+	previousName := role.Name
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&server, member.ServerID).Error; err != nil {
+			return err
+		}
+
+		if !permissions.CanManageRole(member, server.RoleOrder, role.ID) {
+			return errRoleHierarchy
+		}
+
+		if name != "" && name != role.Name {
+			role.Name = name
+			changes = append(changes, fmt.Sprintf("Name: %s", role.Name))
+		}
+
+		if roleUpdateStruct.Permissions != nil && !samePermissions(role.Permissions, roleUpdateStruct.Permissions) {
+			role.Permissions = roleUpdateStruct.Permissions
+			changes = append(changes, fmt.Sprintf("Permissions: %v", role.Permissions))
+		}
+
+		if roleUpdateStruct.Position != nil && *roleUpdateStruct.Position != permissions.RolePosition(server.RoleOrder, role.ID) {
+			if !validRolePosition(member, server.RoleOrder, *roleUpdateStruct.Position, role.ID) {
+				return errRolePosition
+			}
+
+			server.RoleOrder = utils.InsertID(utils.WithoutID(server.RoleOrder, role.ID), role.ID, *roleUpdateStruct.Position)
+
+			if err := tx.Model(&server).Update("role_order", server.RoleOrder).Error; err != nil {
+				return err
+			}
+
+			changes = append(changes, fmt.Sprintf("Position: %d", *roleUpdateStruct.Position))
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+
+		if err := tx.Save(&role).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.RoleUpdated,
+			Content:  fmt.Sprintf("Role %s updated.\n%s", previousName, strings.Join(changes, "\n")),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return roleError(err, "Error Updating Role")
+	}
+
+	if len(changes) > 0 {
+		broadcastRoleChange(config.RoleUpdated, role, server.RoleOrder)
+		socket.WsHub.Refresh <- nil
+	}
+
+	return c.Status(fiber.StatusOK).JSON(role)
+}
+
+func DeleteRole(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var role database.Role
+
+	roleID, err := c.ParamsInt("role")
+
+	if err != nil || db.First(&role, roleID).Error != nil {
+		return apierror.NotFound(apierror.RoleNotFound, "Role Not Found")
+	}
+
+	if role.SystemRole {
+		return apierror.Forbidden(apierror.SystemRole, "System roles cannot be deleted")
+	}
+
+	var server database.Server
+	var overwrittenRooms []int
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&server, member.ServerID).Error; err != nil {
+			return err
+		}
+
+		if !permissions.CanManageRole(member, server.RoleOrder, role.ID) {
+			return errRoleHierarchy
+		}
+
+		if err := tx.Exec("DELETE FROM member_roles WHERE role_id = ?", role.ID).Error; err != nil {
+			return err
+		}
+
+		// The role's overwrites go along with it
+		if err := tx.Model(&database.RoomOverwrite{}).Where("role_id = ?", role.ID).Distinct().Pluck("room_id", &overwrittenRooms).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("role_id = ?", role.ID).Delete(&database.RoomOverwrite{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&role).Error; err != nil {
+			return err
+		}
+
+		server.RoleOrder = utils.WithoutID(server.RoleOrder, role.ID)
+
+		if err := tx.Model(&server).Update("role_order", server.RoleOrder).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.RoleDeleted,
+			Content:  fmt.Sprintf("Role %s deleted", role.Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return roleError(err, "Error Deleting Role")
+	}
+
+	broadcastRoleChange(config.RoleDeleted, role, server.RoleOrder)
+
+	for _, roomID := range overwrittenRooms {
+		socket.WsHub.Overwrites <- roomID
+	}
+
+	socket.WsHub.Refresh <- nil
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Role Deleted",
+	})
+}
+
+// Gives the role passed in the URL to the member passed in the URL.
+func AssignRole(c *fiber.Ctx) error {
+	return changeMemberRole(c, true)
+}
+
+// Takes the role passed in the URL away from the member passed in the URL.
+func UnassignRole(c *fiber.Ctx) error {
+	return changeMemberRole(c, false)
+}
+
+func changeMemberRole(c *fiber.Ctx, assign bool) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	var target database.Member
+
+	if err := db.Preload("Roles").Where("unique_id = ? AND status NOT IN ?", c.Params("member"), database.DepartedStatuses).First(&target).Error; err != nil {
+		return apierror.NotFound(apierror.MemberNotFound, "Member Not Found")
+	}
+
+	var role database.Role
+
+	roleID, err := c.ParamsInt("role")
+
+	if err != nil || db.First(&role, roleID).Error != nil {
+		return apierror.NotFound(apierror.RoleNotFound, "Role Not Found")
+	}
+
+	// Everyone has the system roles, they are never assigned by hand
+	if role.SystemRole {
+		return apierror.Forbidden(apierror.SystemRole, "System roles cannot be assigned or unassigned")
+	}
+
+	hasRole := slices.ContainsFunc(target.Roles, func(r database.Role) bool {
+		return r.ID == role.ID
+	})
+
+	if hasRole == assign {
+		return c.Status(fiber.StatusOK).JSON(target)
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		var server database.Server
+
+		if err := tx.First(&server, member.ServerID).Error; err != nil {
+			return err
+		}
+
+		if !permissions.CanManageRole(member, server.RoleOrder, role.ID) {
+			return errRoleHierarchy
+		}
+
+		// Nobody changes the roles of the owner, or of anyone ranked as high as themselves
+		if permissions.HighestRolePosition(member, server.RoleOrder) >= permissions.HighestRolePosition(target, server.RoleOrder) {
+			return errMemberHierarchy
+		}
+
+		logContent := fmt.Sprintf("Role %s assigned to %s", role.Name, target.DisplayName)
+
+		roles := tx.Model(&database.Member{ID: target.ID}).Association("Roles")
+
+		if assign {
+			if err := roles.Append(&role); err != nil {
+				return err
+			}
+		} else {
+			if err := roles.Delete(&role); err != nil {
+				return err
+			}
+			logContent = fmt.Sprintf("Role %s unassigned from %s", role.Name, target.DisplayName)
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.MemberUpdated,
+			Content:  logContent,
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return roleError(err, "Error Updating Member")
+	}
+
+	if assign {
+		target.Roles = append(target.Roles, role)
+	} else {
+		target.Roles = slices.DeleteFunc(target.Roles, func(r database.Role) bool {
+			return r.ID == role.ID
+		})
+	}
+
+	socket.WsHub.Refresh <- []int{target.ID}
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberUpdated,
+		Data:          target,
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(target)
+}
+
+var errRoleHierarchy = errors.New("role is not below the member's highest role")
+var errRolePosition = errors.New("invalid role position")
+var errMemberHierarchy = errors.New("member is not below the member's highest role")
+
+func roleError(err error, message string) error {
+	switch {
+	case errors.Is(err, errRoleHierarchy):
+		return apierror.Forbidden(apierror.RoleHierarchy, "Roles can only be managed below your highest role")
+	case errors.Is(err, errRolePosition):
+		return apierror.Validation(apierror.Field("position", "Roles can only be placed below your highest role and above the everyone role"))
+	case errors.Is(err, errMemberHierarchy):
+		return apierror.Forbidden(apierror.RoleHierarchy, "Roles can only be changed for members below your highest role")
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return apierror.Conflict(apierror.RoleExists, "Role already exists")
+	default:
+		return apierror.InternalError(message)
+	}
+}
+
+// Permissions must be known, and members can only grant what they have themselves.
+func validateRolePermissions(member database.Member, granted []database.Permission) error {
+	for _, permission := range granted {
+		if !slices.Contains(database.Permissions, permission) {
+			return apierror.Validation(apierror.Field("permissions", fmt.Sprintf("Unknown Permission %s", permission)))
+		}
+
+		if !permissions.Has(member, permission) {
+			return apierror.Forbidden(apierror.MissingPermission, fmt.Sprintf("Cannot grant %s without having it", permission))
+		}
+	}
+
+	return nil
+}
+
+// Reports whether a role can be placed at the position, once the role being
+// moved (0 for a new role) is taken out of the order. The position must be
+// below the member's highest role and above the everyone role, which stays last.
+func validRolePosition(member database.Member, roleOrder []int, position int, roleID int) bool {
+	order := utils.WithoutID(roleOrder, roleID)
+	highest := permissions.HighestRolePosition(member, order)
+
+	return position > highest && position >= 0 && position <= len(order)-1
+}
+
+// Returns the permissions with every permission listed once, in the order they were first listed.
+func uniquePermissions(granted []database.Permission) []database.Permission {
+	result := []database.Permission{}
+
+	for _, permission := range granted {
+		if !slices.Contains(result, permission) {
+			result = append(result, permission)
+		}
+	}
+
+	return result
+}
+
+// Reports whether both lists hold the same permissions. The second list must not repeat any.
+func samePermissions(a []database.Permission, b []database.Permission) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, permission := range b {
+		if !slices.Contains(a, permission) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func broadcastRoleChange(broadcastType config.BroadcastType, role database.Role, roleOrder []int) {
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: broadcastType,
+		Data: fiber.Map{
+			"role":       role,
+			"role_order": roleOrder,
+		},
+	}}
+}
@@ -1,22 +1,27 @@
 package controllers
 
 import (
+	"errors"
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
 	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/socket"
 	"eskimoe-server/utils"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func CategoryWiseRooms(c *fiber.Ctx) error {
-	_, err := c.Locals("Member").(database.Member)
+	member, err := c.Locals("Member").(database.Member)
 
 	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 
 	db := database.Database
@@ -24,45 +29,85 @@ func CategoryWiseRooms(c *fiber.Ctx) error {
 	var categories []database.Category
 
 	if err := db.Preload("Rooms").Find(&categories).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Finding Categories",
-		})
+		return apierror.InternalError("Error Finding Categories")
+	}
+
+	if err := hideRooms(member, categories); err != nil {
+		return apierror.InternalError("Error Finding Permissions")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(categories)
 }
 
+// Leaves out the rooms the member can't see, from both the rooms and the
+// room order of every category.
+func hideRooms(member database.Member, categories []database.Category) error {
+	var overwrites []database.RoomOverwrite
+
+	if err := database.Database.Find(&overwrites).Error; err != nil {
+		return err
+	}
+
+	roomOverwrites := map[int][]database.RoomOverwrite{}
+	for _, overwrite := range overwrites {
+		roomOverwrites[overwrite.RoomID] = append(roomOverwrites[overwrite.RoomID], overwrite)
+	}
+
+	for i, category := range categories {
+		rooms := []database.Room{}
+		roomIDs := []int{}
+
+		for _, room := range category.Rooms {
+			if permissions.CanView(permissions.InRoom(member, roomOverwrites[room.ID])) {
+				rooms = append(rooms, room)
+				roomIDs = append(roomIDs, room.ID)
+			}
+		}
+
+		categories[i].Rooms = rooms
+		categories[i].RoomOrder = utils.OrderedIDs(category.RoomOrder, roomIDs)
+	}
+
+	return nil
+}
+
+// Longest slow mode a room can have, six hours.
+const maxSlowMode = 6 * 60 * 60
+
+func validSlowMode(seconds int) bool {
+	return seconds >= 0 && seconds <= maxSlowMode
+}
+
 func CreateRoom(c *fiber.Ctx) error {
 	member, err := c.Locals("Member").(database.Member)
 
 	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+		return apierror.Unauthorized()
 	}
 	db := database.Database
 
-	if !utils.VerifyOwnerOrPermission(member, "manage_rooms") {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
-	}
-
 	roomCreationStruct := new(struct {
 		Name        string            `json:"name"`
 		Description string            `json:"description"`
 		CategoryID  int               `json:"category_id"`
 		Type        database.RoomType `json:"type"`
+		SlowMode    int               `json:"slow_mode"`
 	})
 
 	if err := c.BodyParser(roomCreationStruct); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"errorCode": fiber.StatusBadRequest,
-			"error":     "Invalid Request",
-		})
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if roomCreationStruct.Type == "" {
+		roomCreationStruct.Type = database.Text
+	}
+
+	if !slices.Contains(database.RoomTypes, roomCreationStruct.Type) {
+		return apierror.Validation(apierror.Field("type", "Invalid Room Type"))
+	}
+
+	if !validSlowMode(roomCreationStruct.SlowMode) {
+		return apierror.Validation(apierror.Field("slow_mode", fmt.Sprintf("Slow mode must be between 0 and %d seconds", maxSlowMode)))
 	}
 
 	newRoom := database.Room{
@@ -70,13 +115,11 @@ func CreateRoom(c *fiber.Ctx) error {
 		Description: roomCreationStruct.Description,
 		CategoryID:  roomCreationStruct.CategoryID,
 		Type:        roomCreationStruct.Type,
+		SlowMode:    roomCreationStruct.SlowMode,
 	}
 
 	if err := db.Create(&newRoom).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Creating Room",
-		})
+		return apierror.InternalError("Error Creating Room")
 	}
 
 	// Update Category Room Order
@@ -84,32 +127,20 @@ func CreateRoom(c *fiber.Ctx) error {
 
 	if err := db.First(&category, roomCreationStruct.CategoryID).Error; err != nil {
 		if err := db.Delete(&newRoom).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"errorCode": fiber.StatusInternalServerError,
-				"error":     "Error Deleting Room",
-			})
+			return apierror.InternalError("Error Deleting Room")
 		}
 
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Finding Category",
-		})
+		return apierror.InternalError("Error Finding Category")
 	}
 
 	category.RoomOrder = append(category.RoomOrder, newRoom.ID)
 
 	if err := db.Save(&category).Error; err != nil {
 		if err := db.Delete(&newRoom).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"errorCode": fiber.StatusInternalServerError,
-				"error":     "Error Deleting Room",
-			})
+			return apierror.InternalError("Error Deleting Room")
 		}
 
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Updating Category",
-		})
+		return apierror.InternalError("Error Updating Category")
 	}
 
 	// Update the Server Log
@@ -121,56 +152,48 @@ func CreateRoom(c *fiber.Ctx) error {
 	}
 
 	if err := db.Create(&serverLog).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Creating Log",
-		})
+		return apierror.InternalError("Error Creating Log")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(newRoom)
+	return c.Status(fiber.StatusCreated).JSON(newRoom)
 }
 
 func UpdateRoom(c *fiber.Ctx) error {
-	member, err := c.Locals("Member").(database.Member)
+	member, ok := c.Locals("Member").(database.Member)
 
-	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+	if !ok {
+		return apierror.Unauthorized()
 	}
 
 	db := database.Database
 
-	if !utils.VerifyOwnerOrPermission(member, "manage_rooms") {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
-	}
-
 	roomUpdateStruct := new(struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
+		Name        string            `json:"name"`
+		Description string            `json:"description"`
+		CategoryID  int               `json:"category_id"`
+		Type        database.RoomType `json:"type"`
+		SlowMode    *int              `json:"slow_mode"` // 0 turns slow mode off, so it is only left alone when missing.
 	})
 
-	roomID := c.Params("room")
+	roomID, err := c.ParamsInt("room")
 
 	if err := c.BodyParser(roomUpdateStruct); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"errorCode": fiber.StatusBadRequest,
-			"error":     "Invalid Request",
-		})
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if roomUpdateStruct.Type != "" && !slices.Contains(database.RoomTypes, roomUpdateStruct.Type) {
+		return apierror.Validation(apierror.Field("type", "Invalid Room Type"))
+	}
+
+	if roomUpdateStruct.SlowMode != nil && !validSlowMode(*roomUpdateStruct.SlowMode) {
+		return apierror.Validation(apierror.Field("slow_mode", fmt.Sprintf("Slow mode must be between 0 and %d seconds", maxSlowMode)))
 	}
 
 	var room database.Room
 	var changes []string
 
-	if err := db.First(&room, roomID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"errorCode": fiber.StatusNotFound,
-			"error":     "Room Not Found",
-		})
+	if err != nil || db.First(&room, roomID).Error != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
 	}
 
 	if roomUpdateStruct.Name != "" && room.Name != roomUpdateStruct.Name {
@@ -183,11 +206,39 @@ func UpdateRoom(c *fiber.Ctx) error {
 		changes = append(changes, fmt.Sprintf("Description: %s", room.Description))
 	}
 
-	if err := db.Save(&room).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Updating Room",
-		})
+	if roomUpdateStruct.Type != "" && room.Type != roomUpdateStruct.Type {
+		room.Type = roomUpdateStruct.Type
+		changes = append(changes, fmt.Sprintf("Type: %s", room.Type))
+	}
+
+	if roomUpdateStruct.SlowMode != nil && room.SlowMode != *roomUpdateStruct.SlowMode {
+		room.SlowMode = *roomUpdateStruct.SlowMode
+		changes = append(changes, fmt.Sprintf("Slow Mode: %ds", room.SlowMode))
+	}
+
+	var movedCategories []database.Category
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&room).Error; err != nil {
+			return err
+		}
+
+		// Moving to another category puts the room at the end of it
+		if roomUpdateStruct.CategoryID == 0 || roomUpdateStruct.CategoryID == room.CategoryID {
+			return nil
+		}
+
+		categories, err := moveRoom(tx, &room, roomUpdateStruct.CategoryID, -1)
+		if err != nil {
+			return err
+		}
+
+		movedCategories = categories
+		changes = append(changes, fmt.Sprintf("Category: %s", categories[len(categories)-1].Name))
+
+		return nil
+	}); err != nil {
+		return roomMoveError(err)
 	}
 
 	// Update the Server Log on changes
@@ -203,60 +254,226 @@ func UpdateRoom(c *fiber.Ctx) error {
 	}
 
 	if err := db.Create(&serverLog).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Creating Log",
-		})
+		return apierror.InternalError("Error Creating Log")
 	}
 
+	broadcastRoomUpdate(room, movedCategories)
+
 	return c.Status(fiber.StatusOK).JSON(room)
 }
 
-func DeleteRoom(c *fiber.Ctx) error {
-	member, err := c.Locals("Member").(database.Member)
+// Moves the room passed in the URL to a position within a category, which
+// may be the category it is already in. Positions start at 0, anything past
+// the end of the category places the room last.
+func MoveRoom(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
 
-	if !err {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	roomMoveStruct := new(struct {
+		CategoryID int `json:"category_id"`
+		Position   int `json:"position"`
+	})
+
+	if err := c.BodyParser(roomMoveStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if roomMoveStruct.Position < 0 {
+		return apierror.Validation(apierror.Field("position", "Position cannot be negative"))
 	}
 
 	db := database.Database
 
-	if !utils.VerifyOwnerOrPermission(member, "manage_rooms") {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"errorCode": fiber.StatusUnauthorized,
-			"error":     "Unauthorized",
-		})
+	var room database.Room
+
+	roomID, err := c.ParamsInt("room")
+
+	if err != nil || db.First(&room, roomID).Error != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
+	}
+
+	if roomMoveStruct.CategoryID == 0 {
+		roomMoveStruct.CategoryID = room.CategoryID
 	}
 
-	roomID := c.Params("room")
+	var categories []database.Category
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+
+		if categories, err = moveRoom(tx, &room, roomMoveStruct.CategoryID, roomMoveStruct.Position); err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.RoomUpdated,
+			Content:  fmt.Sprintf("Room %s moved to position %d in Category %s", room.Name, roomMoveStruct.Position, categories[len(categories)-1].Name),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		return roomMoveError(err)
+	}
+
+	broadcastRoomUpdate(room, categories)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"room":       room,
+		"categories": categories,
+	})
+}
+
+var errCategoryNotFound = errors.New("category not found")
+var errRoomOrderMismatch = errors.New("room order does not match rooms")
+
+// Moves the room to the position in the category, rewriting the room order of the
+// category it leaves and the one it joins. Stale or missing IDs in either order are
+// reconciled against the rooms actually in the category before the move, and the
+// result is checked against them again after it. Returns the categories whose order
+// changed, the one the room is now in last.
+func moveRoom(tx *gorm.DB, room *database.Room, categoryID int, position int) ([]database.Category, error) {
+	// Categories are always locked in ascending order, so two moves in
+	// opposite directions can't each hold the lock the other one waits for.
+	categoryIDs := []int{room.CategoryID}
+	if categoryID != room.CategoryID {
+		categoryIDs = append(categoryIDs, categoryID)
+	}
+	slices.Sort(categoryIDs)
+
+	locked := make(map[int]database.Category, len(categoryIDs))
+
+	for _, id := range categoryIDs {
+		var category database.Category
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&category, id).Error; err != nil {
+			if id == categoryID && errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, errCategoryNotFound
+			}
+			return nil, err
+		}
+
+		locked[id] = category
+	}
+
+	source, target := locked[room.CategoryID], locked[categoryID]
+
+	roomsIn := func(categoryID int) ([]int, error) {
+		var roomIDs []int
+		err := tx.Model(&database.Room{}).Where("category_id = ?", categoryID).Pluck("id", &roomIDs).Error
+		return roomIDs, err
+	}
+
+	sourceRooms, err := roomsIn(source.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	source.RoomOrder = utils.WithoutID(utils.OrderedIDs(source.RoomOrder, sourceRooms), room.ID)
+
+	if source.ID == target.ID {
+		target.RoomOrder = source.RoomOrder
+	} else {
+		targetRooms, err := roomsIn(target.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		target.RoomOrder = utils.OrderedIDs(target.RoomOrder, targetRooms)
+
+		if err := tx.Model(room).Update("category_id", target.ID).Error; err != nil {
+			return nil, err
+		}
+		room.CategoryID = target.ID
+	}
+
+	target.RoomOrder = utils.InsertID(target.RoomOrder, room.ID, position)
+
+	categories := []database.Category{target}
+	if source.ID != target.ID {
+		categories = []database.Category{source, target}
+	}
+
+	for _, category := range categories {
+		roomIDs, err := roomsIn(category.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !utils.SameIDs(category.RoomOrder, roomIDs) {
+			return nil, errRoomOrderMismatch
+		}
+
+		if err := tx.Model(&category).Update("room_order", category.RoomOrder).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return categories, nil
+}
+
+func roomMoveError(err error) error {
+	switch {
+	case errors.Is(err, errCategoryNotFound):
+		return apierror.NotFound(apierror.CategoryNotFound, "Category Not Found")
+	case errors.Is(err, errRoomOrderMismatch):
+		return apierror.Conflict(apierror.ChangedMeanwhile, "Rooms changed during the move, try again")
+	default:
+		return apierror.InternalError("Error Updating Room")
+	}
+}
+
+// Tells everyone who can see the room about the change, and everyone the new
+// room order of any category it moved in or out of, minus the rooms they can't see.
+func broadcastRoomUpdate(room database.Room, categories []database.Category) {
+	socket.WsHub.Broadcast <- socket.Envelope{ViewRoomID: room.ID, Broadcast: config.SocketBroadcast{
+		BroadcastType: config.RoomUpdated,
+		Data: struct {
+			database.Room
+			CategoryID int `json:"category_id"`
+		}{room, room.CategoryID},
+	}}
+
+	for _, category := range categories {
+		socket.WsHub.Broadcast <- socket.Envelope{FilterRooms: true, Broadcast: config.SocketBroadcast{
+			BroadcastType: config.CategoryUpdated,
+			Data:          category,
+		}}
+	}
+}
+
+func DeleteRoom(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	db := database.Database
+
+	roomID, err := c.ParamsInt("room")
 
 	var room database.Room
 
-	if err := db.First(&room, roomID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"errorCode": fiber.StatusNotFound,
-			"error":     "Room Not Found",
-		})
+	if err != nil || db.First(&room, roomID).Error != nil {
+		return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
 	}
 
-	if err := db.Delete(&room).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Deleting Room",
-		})
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return deleteRoomsWithMessages(tx, []int{room.ID})
+	}); err != nil {
+		return apierror.InternalError("Error Deleting Room")
 	}
 
+	socket.WsHub.Overwrites <- room.ID
+
 	// Update Category Room Order
 	var category database.Category
 
 	if err := db.First(&category, room.CategoryID).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Finding Category",
-		})
+		return apierror.InternalError("Error Finding Category")
 	}
 
 	for i, roomID := range category.RoomOrder {
@@ -267,10 +484,7 @@ func DeleteRoom(c *fiber.Ctx) error {
 	}
 
 	if err := db.Save(&category).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Updating Category",
-		})
+		return apierror.InternalError("Error Updating Category")
 	}
 
 	// Update the Server Log
@@ -282,13 +496,37 @@ func DeleteRoom(c *fiber.Ctx) error {
 	}
 
 	if err := db.Create(&serverLog).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"errorCode": fiber.StatusInternalServerError,
-			"error":     "Error Creating Log",
-		})
+		return apierror.InternalError("Error Creating Log")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "Room Deleted",
 	})
 }
+
+// Deletes the rooms along with their messages, overwrites and everything attached to them.
+func deleteRoomsWithMessages(tx *gorm.DB, roomIDs []int) error {
+	messages := tx.Model(&database.Message{}).Select("id").Where("room_id IN ?", roomIDs)
+
+	if err := deleteMessageReactions(tx, "message_id IN (?)", messages); err != nil {
+		return err
+	}
+
+	if err := tx.Where("message_id IN (?)", messages).Delete(&database.MessageRevision{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("message_id IN (?)", messages).Delete(&database.MessageAttachment{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("room_id IN ?", roomIDs).Delete(&database.Message{}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("room_id IN ?", roomIDs).Delete(&database.RoomOverwrite{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("id IN ?", roomIDs).Delete(&database.Room{}).Error
+}
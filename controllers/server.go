@@ -1,14 +1,22 @@
 package controllers
 
 import (
+	"errors"
+	"eskimoe-server/apierror"
 	"eskimoe-server/config"
 	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"eskimoe-server/socket"
+	"fmt"
+	"slices"
 
 	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 func ServerInfo(c *fiber.Ctx) error {
-	_, err := c.Locals("Member").(database.Member)
+	member, err := c.Locals("Member").(database.Member)
 
 	defaultResponse := fiber.Map{
 		"name":    config.Name,
@@ -16,12 +24,18 @@ func ServerInfo(c *fiber.Ctx) error {
 		"version": config.Version,
 	}
 
+	db := database.Database
+
 	if !err {
+		// Tell whoever wants to join what they will need
+		var server database.Server
+		if db.First(&server).Error == nil {
+			defaultResponse["mode"] = server.Mode
+		}
+
 		return c.Status(fiber.StatusOK).JSON(defaultResponse)
 	}
 
-	db := database.Database
-
 	var server database.Server
 
 	if err := db.Model(&database.Server{}).
@@ -36,5 +50,153 @@ func ServerInfo(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(defaultResponse)
 	}
 
+	if err := hideRooms(member, server.Categories); err != nil {
+		return apierror.InternalError("Error Finding Permissions")
+	}
+
 	return c.Status(fiber.StatusOK).JSON(server)
 }
+
+// Switches how new members can join the server. Passphrase mode needs a
+// passphrase, either given along with the mode or kept from before.
+func UpdateJoinMode(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	joinModeStruct := new(struct {
+		Mode       database.ServerMode `json:"mode"`
+		Passphrase string              `json:"passphrase"`
+	})
+
+	if err := c.BodyParser(joinModeStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if !slices.Contains(database.ServerModes, joinModeStruct.Mode) {
+		return apierror.Validation(apierror.Field("mode", "Invalid Join Mode"))
+	}
+
+	db := database.Database
+
+	var server database.Server
+
+	if err := db.First(&server, member.ServerID).Error; err != nil {
+		return apierror.InternalError("Error Finding Server")
+	}
+
+	server.Mode = joinModeStruct.Mode
+	changes := map[string]interface{}{"mode": server.Mode}
+	logContent := fmt.Sprintf("Join mode set to %s", joinModeStruct.Mode)
+
+	if joinModeStruct.Passphrase != "" {
+		hashedPassphrase, err := bcrypt.GenerateFromPassword([]byte(joinModeStruct.Passphrase), bcrypt.DefaultCost)
+
+		if err != nil {
+			return apierror.InternalError("Error Encrypting Passphrase")
+		}
+
+		changes["passphrase"] = string(hashedPassphrase)
+		logContent += ", passphrase changed"
+	} else if joinModeStruct.Mode == database.Passphrase && server.Passphrase == "" {
+		return apierror.Validation(apierror.Field("passphrase", "Passphrase Required"))
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&server).Updates(changes).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.ServerUpdated,
+			Content:  logContent,
+			MemberID: member.ID,
+			ServerID: server.ID,
+		}).Error
+	}); err != nil {
+		return apierror.InternalError("Error Updating Server")
+	}
+
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.ServerUpdated,
+		Data:          fiber.Map{"mode": server.Mode},
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"mode": server.Mode,
+	})
+}
+
+// Hands the server over to another member. The previous owner stays a
+// member, left with whatever its roles allow.
+func TransferOwnership(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	transferStruct := new(struct {
+		UniqueID string `json:"unique_id"`
+	})
+
+	if err := c.BodyParser(transferStruct); err != nil {
+		return apierror.BadRequest("Invalid Request")
+	}
+
+	if transferStruct.UniqueID == member.UniqueID {
+		return apierror.Conflict(apierror.AlreadyOwner, "You already own the server")
+	}
+
+	db := database.Database
+
+	var newOwner database.Member
+
+	if err := db.Where("unique_id = ? AND status NOT IN ?", transferStruct.UniqueID, database.DepartedStatuses).First(&newOwner).Error; err != nil {
+		return apierror.NotFound(apierror.MemberNotFound, "Member Not Found")
+	}
+
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		// Only the current owner can hand the server over, even if two transfers race
+		result := tx.Model(&database.Server{}).
+			Where("id = ? AND owner = ?", member.ServerID, member.UniqueID).
+			Update("owner", newOwner.UniqueID)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return errOwnershipChanged
+		}
+
+		return tx.Create(&database.Log{
+			Type:     database.ServerUpdated,
+			Content:  fmt.Sprintf("Ownership transferred from %s to %s", member.DisplayName, newOwner.DisplayName),
+			MemberID: member.ID,
+			ServerID: member.ServerID,
+		}).Error
+	}); err != nil {
+		if errors.Is(err, errOwnershipChanged) {
+			return apierror.Conflict(apierror.ChangedMeanwhile, "Ownership has already changed")
+		}
+
+		return apierror.InternalError("Error Transferring Ownership")
+	}
+
+	permissions.SetOwner(newOwner.UniqueID)
+
+	socket.WsHub.Refresh <- []int{member.ID, newOwner.ID}
+	socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.ServerUpdated,
+		Data:          fiber.Map{"owner": newOwner.UniqueID},
+	}}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"owner": newOwner.UniqueID,
+	})
+}
+
+var errOwnershipChanged = errors.New("ownership has already changed")
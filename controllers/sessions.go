@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"eskimoe-server/apierror"
+	"eskimoe-server/database"
+	"eskimoe-server/sessions"
+	"eskimoe-server/socket"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Members can be signed in on several devices at once, each with its own session.
+// Sessions can only be seen, refreshed and revoked by the member they belong to.
+
+// Returns the member's sessions that haven't expired, along with the id of the one in use.
+func Sessions(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+	current, sessionOk := c.Locals("Session").(database.Session)
+
+	if !ok || !sessionOk {
+		return apierror.Unauthorized()
+	}
+
+	memberSessions := []database.Session{}
+
+	if err := database.Database.Where("member_id = ? AND expires_at > ?", member.ID, time.Now()).Order("last_used_at desc").Find(&memberSessions).Error; err != nil {
+		return apierror.InternalError("Error Finding Sessions")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"sessions": memberSessions,
+		"current":  current.ID,
+	})
+}
+
+// Swaps the token of the session in use for a new one and extends its expiry.
+func RefreshSession(c *fiber.Ctx) error {
+	session, ok := c.Locals("Session").(database.Session)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	token, err := sessions.Refresh(database.Database, &session)
+	if err != nil {
+		return apierror.InternalError("Error Refreshing Session")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":    "Session Refreshed",
+		"auth_token": token,
+		"session":    session,
+	})
+}
+
+// Revokes the session passed in the URL, signing the member out on that device.
+func DeleteSession(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	sessionID, err := c.ParamsInt("session")
+	if err != nil {
+		return apierror.NotFound(apierror.SessionNotFound, "Session Not Found")
+	}
+
+	result := database.Database.Where("id = ? AND member_id = ?", sessionID, member.ID).Delete(&database.Session{})
+
+	if result.Error != nil {
+		return apierror.InternalError("Error Deleting Session")
+	}
+
+	if result.RowsAffected == 0 {
+		return apierror.NotFound(apierror.SessionNotFound, "Session Not Found")
+	}
+
+	// Sockets opened with the session are signed out along with it
+	socket.WsHub.Evict <- socket.Eviction{MemberID: member.ID, SessionID: sessionID, Reason: "Session Revoked"}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Session Deleted",
+	})
+}
@@ -2,9 +2,11 @@ package database
 
 import (
 	"eskimoe-server/config"
+	"fmt"
 	"log"
 	"os"
 
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
@@ -20,22 +22,22 @@ func Initialize() {
 	var error error
 	switch driver {
 	case "sqlite":
-		Database, error = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+		Database, error = gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true})
 		if error != nil {
 			log.Fatal("Error Connecting to SQLite Database")
 		}
 	case "mysql":
-		Database, error = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		Database, error = gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
 		if error != nil {
 			log.Fatal("Error Connecting to MySQL Database")
 		}
 	case "postgres":
-		Database, error = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		Database, error = gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 		if error != nil {
 			log.Fatal("Error Connecting to PostgreSQL Database")
 		}
 	case "mssql":
-		Database, error = gorm.Open(sqlserver.Open(dsn), &gorm.Config{})
+		Database, error = gorm.Open(sqlserver.Open(dsn), &gorm.Config{TranslateError: true})
 		if error != nil {
 			log.Fatal("Error Connecting to MSSQL Database")
 		}
@@ -45,12 +47,16 @@ func Initialize() {
 
 	log.Default().Println("Connected to Database")
 
+	dedupeRoleNames()
+	dedupeReactions()
+
 	// Migrate the schema
 	Database.AutoMigrate(
 		&Server{},
 		&Category{},
 		&Room{},
 		&Message{},
+		&MessageRevision{},
 		&MessageReaction{},
 		&MessageAttachment{},
 		&ServerReaction{},
@@ -59,8 +65,16 @@ func Initialize() {
 		&Event{},
 		&Log{},
 		&Member{},
+		&RoomOverwrite{},
+		&Ban{},
+		&Session{},
+		&Challenge{},
+		&SocketEvent{},
+		&ReplayState{},
 	)
 
+	migrateCredentials()
+
 	// Setup the server if it doesn't exist
 	if !SetupServer() {
 		// Delete Database
@@ -69,6 +83,7 @@ func Initialize() {
 			&Category{},
 			&Room{},
 			&Message{},
+			&MessageRevision{},
 			&MessageReaction{},
 			&MessageAttachment{},
 			&ServerReaction{},
@@ -77,6 +92,12 @@ func Initialize() {
 			&Event{},
 			&Log{},
 			&Member{},
+			&RoomOverwrite{},
+			&Ban{},
+			&Session{},
+			&Challenge{},
+			&SocketEvent{},
+			&ReplayState{},
 		)
 
 		// If Database is sqlite, delete the file
@@ -100,12 +121,18 @@ func SetupServer() bool {
 		server.Name = config.Name
 		server.Message = config.Message
 
+		// Servers set up before ownership could be handed over
+		if server.Owner == "" {
+			server.Owner = config.Owner
+		}
+
 		return Database.Save(&server).Error == nil
 	}
 
 	newServer := Server{
 		Name:    config.Name,
 		Message: config.Message,
+		Owner:   config.Owner,
 		Mode:    Open,
 	}
 
@@ -173,3 +200,156 @@ func SetupServer() bool {
 
 	return Database.Save(&newServer).Error == nil
 }
+
+// Role names used to be checked for clashes before saving, so two roles could
+// end up with the same name. Later ones get their id added to the name before
+// the index that keeps names unique is created.
+func dedupeRoleNames() {
+	if !Database.Migrator().HasTable(&Role{}) {
+		return
+	}
+
+	var roles []Role
+	if err := Database.Order("id").Find(&roles).Error; err != nil {
+		log.Fatal("Error Finding Roles")
+	}
+
+	seen := map[string]bool{}
+
+	for _, role := range roles {
+		key := fmt.Sprintf("%d:%s", role.ServerID, role.Name)
+		if !seen[key] {
+			seen[key] = true
+			continue
+		}
+
+		if err := Database.Model(&role).Update("name", fmt.Sprintf("%s (%d)", role.Name, role.ID)).Error; err != nil {
+			log.Fatal("Error Renaming Roles")
+		}
+	}
+}
+
+// Reactions used to be checked for clashes before saving, so a server reaction
+// could exist twice and a message could have the same reaction twice. Later
+// duplicates are merged into the first before the indexes that keep them
+// unique are created.
+func dedupeReactions() {
+	migrator := Database.Migrator()
+
+	if !migrator.HasTable(&ServerReaction{}) || !migrator.HasTable(&MessageReaction{}) {
+		return
+	}
+
+	if err := Database.Transaction(func(tx *gorm.DB) error {
+		if !migrator.HasIndex(&ServerReaction{}, "Reaction") {
+			if err := mergeServerReactions(tx); err != nil {
+				return err
+			}
+		}
+
+		if !migrator.HasIndex(&MessageReaction{}, "idx_message_reaction") {
+			return mergeMessageReactions(tx)
+		}
+
+		return nil
+	}); err != nil {
+		log.Fatal("Error Merging Duplicate Reactions")
+	}
+}
+
+// Points every use of a duplicate server reaction at the first one and drops the duplicate.
+func mergeServerReactions(tx *gorm.DB) error {
+	var names []string
+	if err := tx.Model(&ServerReaction{}).Group("reaction").Having("COUNT(*) > 1").Pluck("reaction", &names).Error; err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var reactions []ServerReaction
+		if err := tx.Where("reaction = ?", name).Order("id").Find(&reactions).Error; err != nil {
+			return err
+		}
+
+		for _, duplicate := range reactions[1:] {
+			if err := tx.Model(&MessageReaction{}).Where("reaction_id = ?", duplicate.ID).Update("reaction_id", reactions[0].ID).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Delete(&duplicate).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Moves the members of a duplicate message reaction to the first one and drops the duplicate.
+func mergeMessageReactions(tx *gorm.DB) error {
+	var pairs []struct {
+		MessageID  int
+		ReactionID int
+	}
+	if err := tx.Model(&MessageReaction{}).Select("message_id, reaction_id").Group("message_id, reaction_id").Having("COUNT(*) > 1").Scan(&pairs).Error; err != nil {
+		return err
+	}
+
+	for _, pair := range pairs {
+		var reactions []MessageReaction
+		if err := tx.Preload("Members").Where("message_id = ? AND reaction_id = ?", pair.MessageID, pair.ReactionID).Order("id").Find(&reactions).Error; err != nil {
+			return err
+		}
+
+		first := reactions[0]
+
+		for _, duplicate := range reactions[1:] {
+			// Members who reacted with both are only counted once
+			if len(duplicate.Members) > 0 {
+				if err := tx.Model(&first).Association("Members").Append(duplicate.Members); err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Model(&duplicate).Association("Members").Clear(); err != nil {
+				return err
+			}
+
+			if err := tx.Delete(&duplicate).Error; err != nil {
+				return err
+			}
+		}
+
+		count := tx.Model(&first).Association("Members").Count()
+		if err := tx.Model(&first).Update("count", count).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Members used to be signed in with the bcrypt hash of their unique token,
+// which was kept in plaintext. Sessions replaced the former, hash the latter.
+func migrateCredentials() {
+	if Database.Migrator().HasColumn(&Member{}, "auth_token") {
+		if err := Database.Migrator().DropColumn(&Member{}, "auth_token"); err != nil {
+			log.Fatal("Error Removing Auth Tokens")
+		}
+	}
+
+	var members []Member
+	if err := Database.Where("unique_token NOT LIKE ?", "$2%").Find(&members).Error; err != nil {
+		log.Fatal("Error Finding Unique Tokens")
+	}
+
+	for _, member := range members {
+		hashedToken, err := bcrypt.GenerateFromPassword([]byte(member.UniqueToken), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatal("Error Hashing Unique Tokens")
+		}
+
+		if err := Database.Model(&member).Update("unique_token", string(hashedToken)).Error; err != nil {
+			log.Fatal("Error Hashing Unique Tokens")
+		}
+	}
+}
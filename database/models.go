@@ -31,9 +31,37 @@ const (
 	CreateEvents       Permission = "create_events"
 	ManageEvents       Permission = "manage_events"
 	GenerateInvites    Permission = "generate_invites"
+	ManageReactions    Permission = "manage_reactions"
+	PostAnnouncements  Permission = "post_announcements"
+	ManageInvites      Permission = "manage_invites"
 	Administrator      Permission = "administrator"
 )
 
+var Permissions = []Permission{
+	SendMessage,
+	AddLink,
+	AddFile,
+	AddReaction,
+	CreatePoll,
+	DeleteMessage,
+	ManageRoles,
+	ChangeName,
+	MuteMembers,
+	KickMembers,
+	BanMembers,
+	ManageRooms,
+	RunCommands,
+	ViewLogs,
+	ViewMessageHistory,
+	CreateEvents,
+	ManageEvents,
+	GenerateInvites,
+	ManageReactions,
+	PostAnnouncements,
+	ManageInvites,
+	Administrator,
+}
+
 type MemberStatus string
 
 const (
@@ -41,8 +69,12 @@ const (
 	Idle    MemberStatus = "idle"
 	Offline MemberStatus = "offline"
 	Left    MemberStatus = "left"
+	Banned  MemberStatus = "banned"
 )
 
+// Members who left or were banned are kept around, but are no longer part of the server.
+var DepartedStatuses = []MemberStatus{Left, Banned}
+
 // Room Types: Announcement, Text, Commands, Archive
 type RoomType string
 
@@ -53,6 +85,13 @@ const (
 	Archive      RoomType = "archive"
 )
 
+var RoomTypes = []RoomType{
+	Announcement,
+	Text,
+	Commands,
+	Archive,
+}
+
 type ServerMode string
 
 const (
@@ -61,6 +100,12 @@ const (
 	Passphrase ServerMode = "passphrase"
 )
 
+var ServerModes = []ServerMode{
+	InviteOnly,
+	Open,
+	Passphrase,
+}
+
 type LogType string
 
 const (
@@ -81,13 +126,14 @@ const (
 	RoleUpdated        LogType = "role_updated"
 	InviteGenerated    LogType = "invite_generated"
 	InviteUsed         LogType = "invite_used"
-	InviteDeleted      LogType = "invite_deleted" // Only unused invites can be deleted.
+	InviteDeleted      LogType = "invite_deleted" // Unused invites are deleted, used ones are only revoked.
 	ReactionCreated    LogType = "reaction_created"
 	ReactionDeleted    LogType = "reaction_deleted"
 	ReactionUpdated    LogType = "reaction_updated"
 	EventCreated       LogType = "event_created"
 	EventDeleted       LogType = "event_deleted"
 	EventUpdated       LogType = "event_updated"
+	ServerUpdated      LogType = "server_updated"
 )
 
 type Server struct {
@@ -95,6 +141,7 @@ type Server struct {
 	Name            string                   `gorm:"not null" json:"name"`
 	Message         string                   `json:"message"`
 	PublicURL       string                   `json:"public_url"`
+	Owner           string                   `json:"owner"` // Unique id of the owner, which starts out as OWNER_ID.
 	Mode            ServerMode               `gorm:"not null;default:'open'" json:"mode"`
 	Passphrase      string                   `json:"-"`
 	Categories      []Category               `gorm:"foreignKey:ServerID" json:"categories"`
@@ -126,6 +173,7 @@ type Room struct {
 	Name        string    `gorm:"not null" json:"name"`
 	Description string    `json:"description"`
 	Type        RoomType  `gorm:"not null;default:'text'" json:"type"`
+	SlowMode    int       `gorm:"not null;default:0" json:"slow_mode"` // Seconds a member has to wait between messages, 0 for none.
 	Messages    []Message `gorm:"foreignKey:RoomID" json:"messages,omitempty"`
 	CategoryID  int       `json:"-"`
 	Category    Category  `json:"-"`
@@ -134,27 +182,54 @@ type Room struct {
 }
 
 type Message struct {
-	ID          int                 `gorm:"primaryKey;autoIncrement=true" json:"id"`
+	ID          int                 `gorm:"primaryKey;autoIncrement=true;index:idx_room_message,priority:2" json:"id"`
 	Content     string              `gorm:"not null" json:"content"`
 	AuthorID    int                 `json:"-"`
 	Author      Member              `json:"author"`
 	Reactions   []MessageReaction   `gorm:"foreignKey:MessageID" json:"reactions"`
 	Attachments []MessageAttachment `gorm:"foreignKey:MessageID" json:"attachments"`
 	Edited      bool                `json:"edited"`
-	RoomID      int                 `json:"room_id"`
+	Revisions   []MessageRevision   `gorm:"foreignKey:MessageID" json:"-"`
+	RoomID      int                 `gorm:"not null;index:idx_room_message,priority:1" json:"room_id"`
 	Room        Room                `json:"-"`
 	CreatedAt   time.Time           `json:"created_at"`
 	UpdatedAt   time.Time           `json:"-"`
 }
 
+// RoomOverwrite allows or denies permissions in a single room, on top of what
+// roles grant server-wide. It targets either a role or a member, never both.
+type RoomOverwrite struct {
+	ID        int                             `gorm:"primaryKey;autoIncrement=true" json:"id"`
+	RoomID    int                             `gorm:"not null;index" json:"room_id"`
+	Room      Room                            `json:"-"`
+	RoleID    *int                            `json:"role_id,omitempty"`
+	Role      *Role                           `json:"-"`
+	MemberID  *int                            `json:"-"`
+	Member    *Member                         `json:"member,omitempty"`
+	Allow     datatypes.JSONSlice[Permission] `gorm:"type:json" json:"allow"`
+	Deny      datatypes.JSONSlice[Permission] `gorm:"type:json" json:"deny"`
+	CreatedAt time.Time                       `json:"created_at"`
+	UpdatedAt time.Time                       `json:"-"`
+}
+
+// MessageRevision is the content a message had before one of its edits.
+type MessageRevision struct {
+	ID        int       `gorm:"primaryKey;autoIncrement=true" json:"id"`
+	Content   string    `gorm:"not null" json:"content"`
+	MessageID int       `gorm:"index" json:"message_id"`
+	Message   Message   `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
 type MessageReaction struct {
 	ID         int            `gorm:"primaryKey;autoIncrement=true" json:"-"`
 	Reaction   ServerReaction `gorm:"foreignKey:ReactionID" json:"reaction"`
 	Members    []Member       `gorm:"many2many:message_reaction_members" json:"members"`
 	Count      int            `json:"count"`
-	MessageID  int            `json:"-"`
+	MessageID  int            `gorm:"uniqueIndex:idx_message_reaction" json:"-"`
 	Message    Message        `json:"-"`
-	ReactionID int            `json:"-"`
+	ReactionID int            `gorm:"uniqueIndex:idx_message_reaction" json:"-"`
 	CreatedAt  time.Time      `json:"-"`
 	UpdatedAt  time.Time      `json:"-"`
 }
@@ -171,7 +246,7 @@ type MessageAttachment struct {
 
 type ServerReaction struct {
 	ID        int       `gorm:"primaryKey;autoIncrement=true" json:"-"`
-	Reaction  string    `gorm:"not null" json:"reaction"`
+	Reaction  string    `gorm:"not null;uniqueIndex" json:"reaction"`
 	Color     string    `gorm:"not null" json:"color"`
 	ServerID  int       `json:"-"`
 	Server    Server    `json:"-"`
@@ -179,26 +254,30 @@ type ServerReaction struct {
 	UpdatedAt time.Time `json:"-"`
 }
 
+// Invite lets members join invite only servers. An invite can be used
+// MaxUses times, or any number of times if MaxUses is 0, until it expires.
 type Invite struct {
-	ID            int       `gorm:"primaryKey;autoIncrement=true" json:"-"`
-	Code          string    `gorm:"not null" json:"code"`
-	Used          bool      `json:"used"`
-	GeneratedBy   Member    `gorm:"foreignKey:GeneratedByID" json:"generated_by"`
-	GeneratedByID int       `json:"-"`
-	UsedBy        Member    `gorm:"foreignKey:UsedByID" json:"used_by"`
-	UsedByID      int       `json:"-"`
-	ServerID      int       `json:"-"`
-	Server        Server    `json:"-"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"-"`
+	ID            int        `gorm:"primaryKey;autoIncrement=true" json:"-"`
+	Code          string     `gorm:"not null;uniqueIndex" json:"code"`
+	Used          bool       `json:"used"` // Set once the invite is used up or revoked.
+	Uses          int        `gorm:"not null;default:0" json:"uses"`
+	MaxUses       int        `gorm:"not null;default:0" json:"max_uses"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	GeneratedBy   Member     `gorm:"foreignKey:GeneratedByID" json:"generated_by"`
+	GeneratedByID int        `json:"-"`
+	UsedBy        []Member   `gorm:"many2many:invite_members" json:"used_by"`
+	ServerID      int        `json:"-"`
+	Server        Server     `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"-"`
 }
 
 type Role struct {
 	ID          int                             `gorm:"primaryKey;autoIncrement=true" json:"id"`
-	Name        string                          `gorm:"not null" json:"name"`
+	Name        string                          `gorm:"not null;uniqueIndex:idx_server_role_name" json:"name"`
 	Permissions datatypes.JSONSlice[Permission] `gorm:"type:json" json:"permissions"`
 	SystemRole  bool                            `json:"system_role"`
-	ServerID    int                             `json:"-"`
+	ServerID    int                             `gorm:"uniqueIndex:idx_server_role_name" json:"-"`
 	Server      Server                          `json:"-"`
 	CreatedAt   time.Time                       `json:"created_at"`
 	UpdatedAt   time.Time                       `json:"-"`
@@ -234,8 +313,8 @@ type Log struct {
 type Member struct {
 	ID          int          `gorm:"primaryKey;autoIncrement=true" json:"-"`
 	UniqueID    string       `gorm:"not null;unique" json:"uid"`
-	AuthToken   string       `gorm:"not null" json:"-"`
-	UniqueToken string       `gorm:"not null;unique" json:"-"`
+	UniqueToken string       `gorm:"not null;unique" json:"-"` // Only the bcrypt hash is stored.
+	PublicKey   string       `json:"public_key,omitempty"`     // Base64 Ed25519 key, for members signing in with challenges.
 	DisplayName string       `gorm:"not null" json:"display_name"`
 	About       string       `json:"about"`
 	Pronouns    string       `json:"pronouns"`
@@ -243,8 +322,80 @@ type Member struct {
 	Roles       []Role       `gorm:"many2many:member_roles" json:"roles,omitempty"`
 	ServerID    int          `json:"-"`
 	Server      Server       `json:"-"`
-	Status      MemberStatus `gorm:"not null;default:'online'" json:"status"`
+	Status      MemberStatus `gorm:"not null;default:'offline'" json:"status"`
+	MutedUntil  *time.Time   `json:"muted_until,omitempty"`
 	JoinedAt    time.Time    `json:"joined_at"`
 	CreatedAt   time.Time    `json:"-"`
 	UpdatedAt   time.Time    `json:"-"`
 }
+
+// Reports whether the member is timed out and can't post anything.
+func (m Member) Muted() bool {
+	return m.MutedUntil != nil && m.MutedUntil.After(time.Now())
+}
+
+// Session is a member signed in on one device. The token itself is only
+// ever given to the member, the server keeps its SHA-256 digest.
+type Session struct {
+	ID         int       `gorm:"primaryKey;autoIncrement=true" json:"id"`
+	TokenHash  string    `gorm:"not null;uniqueIndex" json:"-"`
+	MemberID   int       `gorm:"not null;index" json:"-"`
+	Member     Member    `json:"-"`
+	Device     string    `json:"device"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// Challenge is a nonce handed out to a member signing in with its public key.
+// It can only be signed once, and only until it expires.
+type Challenge struct {
+	ID        int       `gorm:"primaryKey;autoIncrement=true" json:"-"`
+	UniqueID  string    `gorm:"not null;index" json:"-"`
+	Nonce     string    `gorm:"not null;uniqueIndex" json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"-"`
+}
+
+// Ban keeps a member out of the server until it expires, or until it is lifted if it never does.
+type Ban struct {
+	ID         int        `gorm:"primaryKey;autoIncrement=true" json:"-"`
+	MemberID   int        `gorm:"not null;uniqueIndex" json:"-"`
+	Member     Member     `json:"member"`
+	Reason     string     `json:"reason"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	BannedByID int        `json:"-"`
+	BannedBy   Member     `gorm:"foreignKey:BannedByID" json:"banned_by"`
+	ServerID   int        `json:"-"`
+	Server     Server     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"-"`
+}
+
+// Reports whether the ban still keeps its member out.
+func (b Ban) Active() bool {
+	return b.ExpiresAt == nil || b.ExpiresAt.After(time.Now())
+}
+
+// SocketEvent is a socket broadcast kept around so reconnecting clients can catch up.
+type SocketEvent struct {
+	Sequence       uint64 `gorm:"primaryKey;autoIncrement:false"`
+	RoomID         int    `gorm:"index"`
+	ViewRoomID     int
+	Permission     Permission
+	ExceptMemberID int
+	FilterRooms    bool
+	Data           []byte `gorm:"not null"`
+	CreatedAt      time.Time
+}
+
+// ReplayState is left behind by a clean shutdown, once every socket event
+// sequenced in the epoch has been saved. Without it the next run can't tell
+// whether saved events are missing and starts a new epoch.
+type ReplayState struct {
+	ID        int `gorm:"primaryKey;autoIncrement=true"`
+	Epoch     int64
+	Sequence  uint64
+	CreatedAt time.Time
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"eskimoe-server/apierror"
 	"eskimoe-server/config"
 	"eskimoe-server/database"
 	"eskimoe-server/middleware"
+	"eskimoe-server/permissions"
 	"eskimoe-server/router"
 	"eskimoe-server/socket"
+	"eskimoe-server/workers"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -15,10 +22,20 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/logger"
 )
 
+// How long open requests get to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	config.Load()
 	database.Initialize()
 
-	app := fiber.New()
+	if err := permissions.LoadOwner(); err != nil {
+		log.Fatal("Error Loading Owner")
+	}
+
+	app := fiber.New(fiber.Config{
+		ErrorHandler: apierror.Handler,
+	})
 	app.Use(cors.New(cors.Config{
 		AllowHeaders: "Origin,Content-Type,Accept,Content-Length,Accept-Language,Accept-Encoding,Connection,Access-Control-Allow-Origin,Authorization",
 		AllowOrigins: "*",
@@ -28,12 +45,31 @@ func main() {
 
 	app.Use(middleware.Json)
 	app.Use(middleware.Auth)
+	app.Use(middleware.RateLimit(config.DefaultRateLimit))
 
 	app.Use(helmet.New())
 
 	go socket.WsHub.Run()
+	go workers.ExpireMutes()
+	go workers.PurgeSessions()
 
 	router.Initialize(app)
 
-	log.Fatal(app.Listen(":" + config.Port))
+	// Stop taking requests on shutdown, so the hub can save what it has to
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		if err := app.ShutdownWithTimeout(shutdownTimeout); err != nil {
+			log.Println("Error Shutting Down:", err)
+		}
+	}()
+
+	if err := app.Listen(":" + config.Port); err != nil {
+		log.Fatal(err)
+	}
+
+	socket.WsHub.Stop()
+	log.Default().Println("Server Stopped")
 }
@@ -1,19 +1,22 @@
 package middleware
 
-// Auth is simple. If a token is provided in the Authorization header, it will be checked against the database.
-// If the token is valid, the member is attached to the context as a local variable.
+// Auth is simple. If a session token is provided in the Authorization header, it will be checked against the database.
+// If the session is valid, the member and the session are attached to the context as local variables.
 // If the token is invalid, the request is still forwarded, but the member is nil.
 // The following function will decide what to do with the member.
 
 import (
 	"eskimoe-server/database"
+	"eskimoe-server/sessions"
+	"slices"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 func Auth(c *fiber.Ctx) error {
-	// Get the Authorization header
-	token := c.Get("Authorization")
+	// Get the Authorization header, the Bearer scheme is optional
+	token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
 
 	// If the token is empty, continue
 	if token == "" {
@@ -23,13 +26,20 @@ func Auth(c *fiber.Ctx) error {
 	// Check the token against the database
 	db := database.Database
 
+	session, ok := sessions.Authenticate(db, token)
+	if !ok {
+		return c.Next()
+	}
+
 	var member database.Member
 
-	if db.Where("auth_token = ?", token).Preload("Roles").First(&member).Error != nil || member.Status == "left" {
+	// Members who left or were banned are no longer let in
+	if db.Preload("Roles").First(&member, session.MemberID).Error != nil || slices.Contains(database.DepartedStatuses, member.Status) {
 		return c.Next()
 	}
 
 	c.Locals("Member", member)
+	c.Locals("Session", session)
 
 	return c.Next()
 }
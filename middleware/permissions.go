@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"eskimoe-server/apierror"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequirePermission only lets members holding the permission through.
+// It must run after Auth, requests without a member are unauthorized.
+func RequirePermission(permission database.Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		member, ok := c.Locals("Member").(database.Member)
+
+		if !ok {
+			return apierror.Unauthorized()
+		}
+
+		if !permissions.Has(member, permission) {
+			return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireRoomPermission only lets members holding the permission in the room
+// from the URL through, with the room's overwrites applied. The resolved
+// permissions are kept in the RoomPermissions local for the handlers.
+func RequireRoomPermission(permission database.Permission) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		member, ok := c.Locals("Member").(database.Member)
+
+		if !ok {
+			return apierror.Unauthorized()
+		}
+
+		roomPermissions, ok := c.Locals("RoomPermissions").(permissions.Set)
+
+		if !ok {
+			roomID, err := c.ParamsInt("room")
+
+			if err != nil {
+				return apierror.NotFound(apierror.RoomNotFound, "Room Not Found")
+			}
+
+			roomPermissions, err = permissions.ForRoom(member, roomID)
+
+			if err != nil {
+				return apierror.InternalError("Error Finding Permissions")
+			}
+
+			c.Locals("RoomPermissions", roomPermissions)
+		}
+
+		if !roomPermissions.Has(permission) {
+			return apierror.Forbidden(apierror.MissingPermission, "Missing Permission")
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireOwner only lets the owner of the server through.
+func RequireOwner(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	if !permissions.IsOwner(member) {
+		return apierror.Forbidden(apierror.OwnerOnly, "Only the owner can do this")
+	}
+
+	return c.Next()
+}
+
+// RequireUnmuted keeps timed out members from posting until their mute is over.
+func RequireUnmuted(c *fiber.Ctx) error {
+	member, ok := c.Locals("Member").(database.Member)
+
+	if !ok {
+		return apierror.Unauthorized()
+	}
+
+	if member.Muted() {
+		return apierror.Forbidden(apierror.Muted, "Muted").With("muted_until", member.MutedUntil)
+	}
+
+	return c.Next()
+}
@@ -0,0 +1,34 @@
+package middleware
+
+// Requests are limited per member, or per address for anyone who isn't signed in.
+// Going over a limit is answered with 429 and how many seconds to wait in Retry-After.
+
+import (
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/ratelimit"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RateLimit gives every member or address its own budget of requests. Routes
+// sharing the returned handler share the budget.
+func RateLimit(budget config.RateLimit) fiber.Handler {
+	limiter := ratelimit.New(budget.Requests, budget.Per)
+
+	return func(c *fiber.Ctx) error {
+		key := "ip:" + c.IP()
+
+		if member, ok := c.Locals("Member").(database.Member); ok {
+			key = fmt.Sprintf("member:%d", member.ID)
+		}
+
+		if allowed, wait := limiter.Allow(key); !allowed {
+			return apierror.TooManyRequests(apierror.RateLimited, "Too Many Requests", wait)
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package permissions
+
+// The owner is kept in the server row so it can be handed over. OWNER_ID only
+// names the first owner, and OWNER_TOKEN is what proves it when it first joins.
+// The owner is checked on almost every request, so it is kept in memory too.
+
+import (
+	"eskimoe-server/database"
+	"sync"
+)
+
+var owner struct {
+	sync.RWMutex
+	uniqueID string
+}
+
+// LoadOwner reads the owner from the server. It has to run once the database is set up.
+func LoadOwner() error {
+	var server database.Server
+
+	if err := database.Database.First(&server).Error; err != nil {
+		return err
+	}
+
+	SetOwner(server.Owner)
+
+	return nil
+}
+
+// SetOwner changes who is treated as the owner, once the change is saved.
+func SetOwner(uniqueID string) {
+	owner.Lock()
+	defer owner.Unlock()
+
+	owner.uniqueID = uniqueID
+}
+
+// Returns the unique id of the owner.
+func Owner() string {
+	owner.RLock()
+	defer owner.RUnlock()
+
+	return owner.uniqueID
+}
+
+func IsOwner(member database.Member) bool {
+	return member.UniqueID != "" && Owner() == member.UniqueID
+}
@@ -0,0 +1,66 @@
+package permissions
+
+// Permissions are granted through roles. A member holds every permission of
+// every role it has, Administrator grants all of them, and the owner of the
+// server holds all of them regardless of roles.
+
+import (
+	"eskimoe-server/database"
+)
+
+// Set is the effective permissions of a member.
+type Set map[database.Permission]bool
+
+// Resolves the effective permissions of the member from all of its roles.
+// The member's roles must be loaded.
+func Effective(member database.Member) Set {
+	set := Set{}
+
+	if IsOwner(member) {
+		return all()
+	}
+
+	for _, role := range member.Roles {
+		for _, permission := range role.Permissions {
+			set[permission] = true
+		}
+	}
+
+	if set[database.Administrator] {
+		return all()
+	}
+
+	return set
+}
+
+// Reports whether the member holds the permission.
+func Has(member database.Member, permission database.Permission) bool {
+	return Effective(member).Has(permission)
+}
+
+func (s Set) Has(permission database.Permission) bool {
+	return s[permission]
+}
+
+// Returns the permissions in the set, in the order they are declared in.
+func (s Set) List() []database.Permission {
+	list := []database.Permission{}
+
+	for _, permission := range database.Permissions {
+		if s[permission] {
+			list = append(list, permission)
+		}
+	}
+
+	return list
+}
+
+func all() Set {
+	set := make(Set, len(database.Permissions))
+
+	for _, permission := range database.Permissions {
+		set[permission] = true
+	}
+
+	return set
+}
@@ -0,0 +1,37 @@
+package permissions
+
+import (
+	"eskimoe-server/database"
+	"slices"
+)
+
+// The role order lists roles from the highest to the lowest, the everyone role is always last.
+
+// Returns the position of the role in the role order, 0 being the highest.
+// Roles missing from the order rank below every other role.
+func RolePosition(roleOrder []int, roleID int) int {
+	if position := slices.Index(roleOrder, roleID); position != -1 {
+		return position
+	}
+
+	return len(roleOrder)
+}
+
+// Returns the position of the member's highest role. The owner is above every role, at -1.
+func HighestRolePosition(member database.Member, roleOrder []int) int {
+	if IsOwner(member) {
+		return -1
+	}
+
+	highest := len(roleOrder)
+	for _, role := range member.Roles {
+		highest = min(highest, RolePosition(roleOrder, role.ID))
+	}
+
+	return highest
+}
+
+// Members can only manage roles strictly below their highest role.
+func CanManageRole(member database.Member, roleOrder []int, roleID int) bool {
+	return HighestRolePosition(member, roleOrder) < RolePosition(roleOrder, roleID)
+}
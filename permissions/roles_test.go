@@ -0,0 +1,97 @@
+package permissions
+
+import (
+	"eskimoe-server/database"
+	"testing"
+)
+
+var (
+	everyoneRole = database.Role{
+		ID:          1,
+		Name:        "everyone",
+		SystemRole:  true,
+		Permissions: []database.Permission{database.ViewMessageHistory, database.SendMessage},
+	}
+	modRole   = database.Role{ID: 2, Name: "mod", Permissions: []database.Permission{database.DeleteMessage}}
+	helpRole  = database.Role{ID: 3, Name: "help"}
+	otherRole = database.Role{ID: 4, Name: "other"}
+	adminRole = database.Role{ID: 5, Name: "admin", Permissions: []database.Permission{database.Administrator}}
+)
+
+func TestCanManageRole(t *testing.T) {
+	SetOwner("owner")
+	defer SetOwner("")
+
+	// From the highest to the lowest, everyone is always last
+	roleOrder := []int{adminRole.ID, modRole.ID, helpRole.ID, everyoneRole.ID}
+
+	tests := []struct {
+		name   string
+		member database.Member
+		roleID int
+		want   bool
+	}{
+		{
+			name:   "role below the highest",
+			member: database.Member{UniqueID: "mod", Roles: []database.Role{everyoneRole, modRole}},
+			roleID: helpRole.ID,
+			want:   true,
+		},
+		{
+			name:   "own highest role",
+			member: database.Member{UniqueID: "mod", Roles: []database.Role{everyoneRole, modRole}},
+			roleID: modRole.ID,
+			want:   false,
+		},
+		{
+			name:   "role above the highest",
+			member: database.Member{UniqueID: "mod", Roles: []database.Role{everyoneRole, modRole}},
+			roleID: adminRole.ID,
+			want:   false,
+		},
+		{
+			name:   "highest of several roles counts",
+			member: database.Member{UniqueID: "mod", Roles: []database.Role{everyoneRole, helpRole, modRole}},
+			roleID: helpRole.ID,
+			want:   true,
+		},
+		{
+			name:   "everyone role from the lowest role",
+			member: database.Member{UniqueID: "help", Roles: []database.Role{everyoneRole, helpRole}},
+			roleID: everyoneRole.ID,
+			want:   true,
+		},
+		{
+			name:   "only the everyone role",
+			member: database.Member{UniqueID: "member", Roles: []database.Role{everyoneRole}},
+			roleID: everyoneRole.ID,
+			want:   false,
+		},
+		{
+			name:   "role missing from the order ranks last",
+			member: database.Member{UniqueID: "help", Roles: []database.Role{everyoneRole, helpRole}},
+			roleID: otherRole.ID,
+			want:   true,
+		},
+		{
+			name:   "administrator still follows the order",
+			member: database.Member{UniqueID: "admin", Roles: []database.Role{everyoneRole, adminRole}},
+			roleID: adminRole.ID,
+			want:   false,
+		},
+		{
+			name:   "owner is above every role",
+			member: database.Member{UniqueID: "owner", Roles: []database.Role{everyoneRole}},
+			roleID: adminRole.ID,
+			want:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CanManageRole(test.member, roleOrder, test.roleID); got != test.want {
+				t.Errorf("CanManageRole(%s, %d) = %v, want %v", test.member.UniqueID, test.roleID, got, test.want)
+			}
+		})
+	}
+}
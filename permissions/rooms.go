@@ -0,0 +1,85 @@
+package permissions
+
+import (
+	"eskimoe-server/database"
+	"slices"
+)
+
+// Rooms can override what roles grant server-wide. Overwrites are applied in
+// layers: first the everyone role's, then those of the member's other roles,
+// then the member's own. Within a layer denies apply before allows, so an
+// allow on any of the member's roles beats a deny on another one.
+// The owner and administrators are never affected by overwrites.
+
+// Resolves the member's permissions in a room with the given overwrites.
+// The member's roles must be loaded.
+func InRoom(member database.Member, overwrites []database.RoomOverwrite) Set {
+	set := Effective(member)
+
+	if set.Has(database.Administrator) {
+		return set
+	}
+
+	roleIDs := make([]int, 0, len(member.Roles))
+	everyoneID := 0
+	for _, role := range member.Roles {
+		if isEveryone(role) {
+			everyoneID = role.ID
+			continue
+		}
+		roleIDs = append(roleIDs, role.ID)
+	}
+
+	var everyone, roles, own []database.RoomOverwrite
+	for _, overwrite := range overwrites {
+		switch {
+		case overwrite.RoleID != nil && *overwrite.RoleID == everyoneID:
+			everyone = append(everyone, overwrite)
+		case overwrite.RoleID != nil && slices.Contains(roleIDs, *overwrite.RoleID):
+			roles = append(roles, overwrite)
+		case overwrite.MemberID != nil && *overwrite.MemberID == member.ID:
+			own = append(own, overwrite)
+		}
+	}
+
+	for _, layer := range [][]database.RoomOverwrite{everyone, roles, own} {
+		set.apply(layer)
+	}
+
+	return set
+}
+
+// Loads the room's overwrites and resolves the member's permissions in it.
+func ForRoom(member database.Member, roomID int) (Set, error) {
+	var overwrites []database.RoomOverwrite
+
+	if err := database.Database.Where("room_id = ?", roomID).Find(&overwrites).Error; err != nil {
+		return nil, err
+	}
+
+	return InRoom(member, overwrites), nil
+}
+
+// Reports whether the member can see the room at all. Members who can't
+// read a room's history don't get to see the room or anything sent in it.
+func CanView(set Set) bool {
+	return set.Has(database.ViewMessageHistory)
+}
+
+func (s Set) apply(layer []database.RoomOverwrite) {
+	for _, overwrite := range layer {
+		for _, permission := range overwrite.Deny {
+			delete(s, permission)
+		}
+	}
+
+	for _, overwrite := range layer {
+		for _, permission := range overwrite.Allow {
+			s[permission] = true
+		}
+	}
+}
+
+func isEveryone(role database.Role) bool {
+	return role.SystemRole && role.Name == "everyone"
+}
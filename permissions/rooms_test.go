@@ -0,0 +1,141 @@
+package permissions
+
+import (
+	"eskimoe-server/database"
+	"slices"
+	"testing"
+)
+
+func roleOverwrite(role database.Role, allow []database.Permission, deny []database.Permission) database.RoomOverwrite {
+	return database.RoomOverwrite{RoleID: &role.ID, Allow: allow, Deny: deny}
+}
+
+func memberOverwrite(memberID int, allow []database.Permission, deny []database.Permission) database.RoomOverwrite {
+	return database.RoomOverwrite{MemberID: &memberID, Allow: allow, Deny: deny}
+}
+
+func TestInRoom(t *testing.T) {
+	SetOwner("owner")
+	defer SetOwner("")
+
+	member := database.Member{ID: 10, UniqueID: "member", Roles: []database.Role{everyoneRole, modRole, helpRole}}
+	admin := database.Member{ID: 11, UniqueID: "admin", Roles: []database.Role{everyoneRole, adminRole}}
+	owner := database.Member{ID: 12, UniqueID: "owner", Roles: []database.Role{everyoneRole}}
+
+	send := []database.Permission{database.SendMessage}
+	view := []database.Permission{database.ViewMessageHistory}
+
+	tests := []struct {
+		name       string
+		member     database.Member
+		overwrites []database.RoomOverwrite
+		want       []database.Permission
+	}{
+		{
+			name:   "no overwrites",
+			member: member,
+			want:   []database.Permission{database.SendMessage, database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:       "everyone deny",
+			member:     member,
+			overwrites: []database.RoomOverwrite{roleOverwrite(everyoneRole, nil, send)},
+			want:       []database.Permission{database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "role allow beats everyone deny",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(everyoneRole, nil, send),
+				roleOverwrite(helpRole, send, nil),
+			},
+			want: []database.Permission{database.SendMessage, database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "role deny beats everyone allow",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(everyoneRole, send, nil),
+				roleOverwrite(modRole, nil, send),
+			},
+			want: []database.Permission{database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "allow on one role beats deny on another",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(modRole, nil, send),
+				roleOverwrite(helpRole, send, nil),
+			},
+			want: []database.Permission{database.SendMessage, database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "member deny beats role allow",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(helpRole, send, nil),
+				memberOverwrite(member.ID, nil, send),
+			},
+			want: []database.Permission{database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "member allow beats role deny",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(everyoneRole, nil, view),
+				roleOverwrite(modRole, nil, view),
+				memberOverwrite(member.ID, view, nil),
+			},
+			want: []database.Permission{database.SendMessage, database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "deny and allow in the member's own layer",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				memberOverwrite(member.ID, send, send),
+			},
+			want: []database.Permission{database.SendMessage, database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "overwrites for roles and members it doesn't have",
+			member: member,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(otherRole, nil, view),
+				memberOverwrite(99, nil, send),
+			},
+			want: []database.Permission{database.SendMessage, database.DeleteMessage, database.ViewMessageHistory},
+		},
+		{
+			name:   "administrators ignore overwrites",
+			member: admin,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(everyoneRole, nil, view),
+				memberOverwrite(admin.ID, nil, view),
+			},
+			want: all().List(),
+		},
+		{
+			name:   "the owner ignores overwrites",
+			member: owner,
+			overwrites: []database.RoomOverwrite{
+				roleOverwrite(everyoneRole, nil, view),
+				memberOverwrite(owner.ID, nil, view),
+			},
+			want: all().List(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Permissions are listed in the order they are declared in, so the lists compare as sets
+			want := Set{}
+			for _, permission := range test.want {
+				want[permission] = true
+			}
+
+			if got := InRoom(test.member, test.overwrites).List(); !slices.Equal(got, want.List()) {
+				t.Errorf("InRoom() = %v, want %v", got, want.List())
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Cooldowns keep keys from being used again until a wait is over, where the
+// wait can differ every time, like the slow mode of a room.
+type Cooldowns struct {
+	mu        sync.Mutex
+	until     map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewCooldowns() *Cooldowns {
+	return &Cooldowns{
+		until:     make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take starts the key's cooldown if the last one is over. Otherwise it
+// returns how long is left of it.
+func (c *Cooldowns) Take(key string, wait time.Duration) (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(c.lastSweep) > sweepInterval {
+		for cooling, until := range c.until {
+			if !now.Before(until) {
+				delete(c.until, cooling)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if until, ok := c.until[key]; ok && now.Before(until) {
+		return false, until.Sub(now)
+	}
+
+	c.until[key] = now.Add(wait)
+
+	return true, 0
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+// Limits are token buckets. A bucket holds up to a budget of requests and
+// refills at an even pace over the budget's period, so short bursts are
+// allowed but the average rate can't go over the budget.
+
+import (
+	"sync"
+	"time"
+)
+
+// How often buckets that have refilled completely are dropped.
+const sweepInterval = time.Minute
+
+// Bucket is a single token bucket. It is not safe for concurrent use on its own.
+type Bucket struct {
+	tokens  float64
+	burst   float64
+	rate    float64 // Tokens per second.
+	updated time.Time
+}
+
+func NewBucket(requests int, per time.Duration) *Bucket {
+	return &Bucket{
+		tokens:  float64(requests),
+		burst:   float64(requests),
+		rate:    float64(requests) / per.Seconds(),
+		updated: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket. If there are none left, it returns
+// how long it will be until there is one.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	now := time.Now()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Reports whether the bucket would be full by now, so dropping it changes nothing.
+func (b *Bucket) full() bool {
+	return b.tokens+time.Since(b.updated).Seconds()*b.rate >= b.burst
+}
+
+// Limiter keeps a bucket for every key, like a member or an address.
+type Limiter struct {
+	mu        sync.Mutex
+	requests  int
+	per       time.Duration
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+func New(requests int, per time.Duration) *Limiter {
+	return &Limiter{
+		requests:  requests,
+		per:       per,
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the key's bucket. If there are none left, it
+// returns how long it will be until there is one.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.lastSweep) > sweepInterval {
+		l.sweep()
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewBucket(l.requests, l.per)
+		l.buckets[key] = bucket
+	}
+
+	return bucket.Allow()
+}
+
+// The caller must hold l.mu.
+func (l *Limiter) sweep() {
+	for key, bucket := range l.buckets {
+		if bucket.full() {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = time.Now()
+}
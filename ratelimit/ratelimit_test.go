@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int
+		per      time.Duration
+		elapsed  time.Duration // How long ago the bucket was last used before the final request.
+		spent    int           // Requests made right before the final request.
+		allowed  bool
+		minWait  time.Duration
+		maxWait  time.Duration
+	}{
+		{
+			name:     "full bucket",
+			requests: 3,
+			per:      time.Minute,
+			allowed:  true,
+		},
+		{
+			name:     "last token of a burst",
+			requests: 3,
+			per:      time.Minute,
+			spent:    2,
+			allowed:  true,
+		},
+		{
+			name:     "burst spent",
+			requests: 3,
+			per:      time.Minute,
+			spent:    3,
+			allowed:  false,
+			minWait:  19 * time.Second,
+			maxWait:  20 * time.Second,
+		},
+		{
+			name:     "refilled a token",
+			requests: 3,
+			per:      time.Minute,
+			spent:    3,
+			elapsed:  21 * time.Second,
+			allowed:  true,
+		},
+		{
+			name:     "refilled part of a token",
+			requests: 3,
+			per:      time.Minute,
+			spent:    3,
+			elapsed:  10 * time.Second,
+			allowed:  false,
+			minWait:  9 * time.Second,
+			maxWait:  10 * time.Second,
+		},
+		{
+			name:     "refills no further than the burst",
+			requests: 2,
+			per:      time.Second,
+			spent:    2,
+			elapsed:  time.Hour,
+			allowed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := NewBucket(test.requests, test.per)
+
+			for i := 0; i < test.spent; i++ {
+				if allowed, _ := bucket.Allow(); !allowed {
+					t.Fatalf("request %d was limited", i+1)
+				}
+			}
+
+			bucket.updated = bucket.updated.Add(-test.elapsed)
+
+			allowed, wait := bucket.Allow()
+
+			if allowed != test.allowed {
+				t.Fatalf("allowed = %v, want %v", allowed, test.allowed)
+			}
+
+			if wait < test.minWait || wait > test.maxWait {
+				t.Errorf("wait = %v, want between %v and %v", wait, test.minWait, test.maxWait)
+			}
+
+			if bucket.tokens > bucket.burst {
+				t.Errorf("tokens = %v, more than the burst of %v", bucket.tokens, bucket.burst)
+			}
+		})
+	}
+}
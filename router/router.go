@@ -1,10 +1,12 @@
 package router
 
 import (
+	"eskimoe-server/apierror"
+	"eskimoe-server/config"
 	"eskimoe-server/controllers"
 	"eskimoe-server/database"
+	"eskimoe-server/middleware"
 	"eskimoe-server/socket"
-	"log"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
@@ -13,74 +15,103 @@ import (
 func Initialize(router *fiber.App) {
 	// Server Endpoints
 	router.Get("/", controllers.ServerInfo)
+	router.Put("/mode", middleware.RequireOwner, controllers.UpdateJoinMode)
+	router.Put("/owner", middleware.RequireOwner, controllers.TransferOwnership)
+
+	// Joining and logging in share a budget, on top of the one for every request
+	authLimit := middleware.RateLimit(config.AuthRateLimit)
 
 	members := router.Group("/members")
 
 	// Members Endpoints
-	members.Post("/join", controllers.JoinServer)
+	members.Post("/join", authLimit, controllers.JoinServer)
+	members.Post("/challenge", authLimit, controllers.LoginChallenge)
+	members.Post("/login", authLimit, controllers.Login)
 	members.Delete("/leave", controllers.LeaveServer)
 	members.Get("/me", controllers.Me)
 	members.Post("/me", controllers.Me)
+	members.Put("/:member/roles/:role", middleware.RequirePermission(database.ManageRoles), controllers.AssignRole)
+	members.Delete("/:member/roles/:role", middleware.RequirePermission(database.ManageRoles), controllers.UnassignRole)
+	members.Post("/:member/kick", middleware.RequirePermission(database.KickMembers), controllers.KickMember)
+	members.Post("/:member/ban", middleware.RequirePermission(database.BanMembers), controllers.BanMember)
+	members.Delete("/:member/ban", middleware.RequirePermission(database.BanMembers), controllers.UnbanMember)
+	members.Post("/:member/mute", middleware.RequirePermission(database.MuteMembers), controllers.MuteMember)
+	members.Delete("/:member/mute", middleware.RequirePermission(database.MuteMembers), controllers.UnmuteMember)
+
+	// Sessions Endpoints
+	sessions := router.Group("/sessions")
+
+	sessions.Get("/", controllers.Sessions)
+	sessions.Post("/refresh", controllers.RefreshSession)
+	sessions.Delete("/:session", controllers.DeleteSession)
+
+	// Roles Endpoints
+	roles := router.Group("/roles")
+
+	roles.Get("/", controllers.Roles)
+	roles.Post("/new", middleware.RequirePermission(database.ManageRoles), controllers.CreateRole)
+	roles.Patch("/:role", middleware.RequirePermission(database.ManageRoles), controllers.UpdateRole)
+	roles.Delete("/:role", middleware.RequirePermission(database.ManageRoles), controllers.DeleteRole)
+
+	// Categories Endpoints
+	categories := router.Group("/categories", middleware.RequirePermission(database.ManageRooms))
+
+	categories.Post("/new", controllers.CreateCategory)
+	categories.Put("/order", controllers.UpdateCategoryOrder)
+	categories.Patch("/:category", controllers.UpdateCategory)
+	categories.Delete("/:category", controllers.DeleteCategory)
 
 	// Rooms Endpoints
 	rooms := router.Group("/rooms")
 
 	rooms.Get("/", controllers.CategoryWiseRooms)
-	rooms.Post("/new", controllers.CreateRoom)
-	rooms.Patch("/:room", controllers.UpdateRoom)
-	rooms.Delete("/:room", controllers.DeleteRoom)
+	rooms.Post("/new", middleware.RequirePermission(database.ManageRooms), controllers.CreateRoom)
+	rooms.Patch("/:room", middleware.RequirePermission(database.ManageRooms), controllers.UpdateRoom)
+	rooms.Put("/:room/position", middleware.RequirePermission(database.ManageRooms), controllers.MoveRoom)
+	rooms.Delete("/:room", middleware.RequirePermission(database.ManageRooms), controllers.DeleteRoom)
+	rooms.Get("/:room/overwrites", middleware.RequirePermission(database.ManageRooms), controllers.RoomOverwrites)
+	rooms.Put("/:room/overwrites/roles/:role", middleware.RequirePermission(database.ManageRooms), controllers.UpdateRoleOverwrite)
+	rooms.Delete("/:room/overwrites/roles/:role", middleware.RequirePermission(database.ManageRooms), controllers.DeleteRoleOverwrite)
+	rooms.Put("/:room/overwrites/members/:member", middleware.RequirePermission(database.ManageRooms), controllers.UpdateMemberOverwrite)
+	rooms.Delete("/:room/overwrites/members/:member", middleware.RequirePermission(database.ManageRooms), controllers.DeleteMemberOverwrite)
 
 	// Messages Endpoints
-	messages := rooms.Group("/:room/messages")
+	messages := rooms.Group("/:room/messages", middleware.RequireRoomPermission(database.ViewMessageHistory))
 
 	messages.Get("/", controllers.GetMessages)
-	messages.Post("/new", controllers.SendMessage)
+	messages.Post("/new", middleware.RequireUnmuted, middleware.RequireRoomPermission(database.SendMessage), middleware.RateLimit(config.MessageRateLimit), controllers.SendMessage)
+	messages.Patch("/:message", middleware.RequireUnmuted, controllers.EditMessage)
+	messages.Get("/:message/revisions", middleware.RequirePermission(database.ViewLogs), controllers.MessageRevisions)
+	messages.Put("/:message/reactions/:reaction", middleware.RequireUnmuted, middleware.RequireRoomPermission(database.AddReaction), controllers.AddReaction)
+	messages.Delete("/:message/reactions/:reaction", middleware.RequireUnmuted, controllers.RemoveReaction)
 	messages.Delete("/:message", controllers.DeleteMessage)
 
+	// Invites Endpoints
+	invites := router.Group("/invites")
+
+	invites.Get("/", controllers.Invites)
+	invites.Post("/new", middleware.RequirePermission(database.GenerateInvites), controllers.CreateInvite)
+	invites.Delete("/:invite", controllers.DeleteInvite)
+
+	// Reactions Endpoints
+	reactions := router.Group("/reactions")
+
+	reactions.Get("/", controllers.ServerReactions)
+	reactions.Post("/new", middleware.RequirePermission(database.ManageReactions), controllers.CreateServerReaction)
+	reactions.Patch("/:reaction", middleware.RequirePermission(database.ManageReactions), controllers.UpdateServerReaction)
+	reactions.Delete("/:reaction", middleware.RequirePermission(database.ManageReactions), controllers.DeleteServerReaction)
+
 	router.Use("/ws", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Locals("SocketCapable", true)
 			return c.Next()
 		}
-		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{
-			"errorCode": fiber.StatusUpgradeRequired,
-			"error":     "Socket Upgrade Required.",
-		})
+		return apierror.New(fiber.StatusUpgradeRequired, apierror.UpgradeRequired, "Socket Upgrade Required.")
 	})
 
-	router.Get("/ws/listen", websocket.New(func(c *websocket.Conn) {
-		if _, ok := c.Locals("Member").(database.Member); !ok {
-			log.Println("Unauthorized Member Disconnected")
-			c.Close()
-			return
-		}
-
-		log.Println("Connected Member", c.Locals("Member").(database.Member).DisplayName)
-
-		socket.WsHub.Register <- c
-		defer func() {
-			socket.WsHub.Unregister <- c
-		}()
-
-		for {
-			_, msg, err := c.ReadMessage()
-			if err != nil {
-				log.Println("Read Error:", err)
-				return
-			}
-
-			// Handle Ping messages
-			if string(msg) == string(rune(websocket.PingMessage)) {
-				c.WriteMessage(websocket.PongMessage, []byte(string(rune(websocket.PongMessage))))
-			}
-		}
-
-	}))
+	router.Get("/ws/listen", websocket.New(socket.Listen))
 
 	router.Use(func(c *fiber.Ctx) error {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"errorCode": fiber.StatusNotFound,
-			"error":     "Unsupported Endpoint.",
-		})
+		return apierror.NotFound(apierror.EndpointNotFound, "Unsupported Endpoint.")
 	})
 }
@@ -0,0 +1,77 @@
+package sessions
+
+// Members can register an Ed25519 public key instead of sharing a unique token
+// with every server they join. To sign in, they ask for a nonce and sign it
+// along with the host they are talking to and their unique id. The host keeps
+// another server from passing its own nonces along and signing in as the member.
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"eskimoe-server/database"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How long a nonce can be signed for.
+const challengeLifetime = 5 * time.Minute
+
+// Returns the message a member signs to answer a challenge. The host is the
+// server's public host, port included.
+func ChallengeMessage(host string, uniqueID string, nonce string) []byte {
+	return []byte(fmt.Sprintf("eskimoe-login:%s:%s:%s", host, uniqueID, nonce))
+}
+
+// Reports whether the key is a base64 encoded Ed25519 public key.
+func ValidPublicKey(publicKey string) bool {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	return err == nil && len(key) == ed25519.PublicKeySize
+}
+
+// NewChallenge hands out a nonce for the unique id. Nonces are handed out
+// whether or not a member has the unique id, so they don't give members away.
+func NewChallenge(tx *gorm.DB, uniqueID string) (database.Challenge, error) {
+	nonce, err := newToken()
+	if err != nil {
+		return database.Challenge{}, err
+	}
+
+	challenge := database.Challenge{
+		UniqueID:  uniqueID,
+		Nonce:     nonce,
+		ExpiresAt: time.Now().Add(challengeLifetime),
+	}
+
+	if err := tx.Create(&challenge).Error; err != nil {
+		return database.Challenge{}, err
+	}
+
+	return challenge, nil
+}
+
+// VerifyChallenge checks the signature of a nonce handed out to the member.
+// The nonce is used up either way, so every attempt needs a new one.
+func VerifyChallenge(tx *gorm.DB, host string, member database.Member, nonce string, signature string) bool {
+	if member.PublicKey == "" || nonce == "" {
+		return false
+	}
+
+	result := tx.Where("unique_id = ? AND nonce = ? AND expires_at > ?", member.UniqueID, nonce, time.Now()).Delete(&database.Challenge{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+
+	key, err := base64.StdEncoding.DecodeString(member.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+
+	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(key, ChallengeMessage(host, member.UniqueID, nonce), decodedSignature)
+}
@@ -0,0 +1,187 @@
+package sessions
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"eskimoe-server/database"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testHost = "chat.example.com:8000"
+
+// Opens an empty in-memory database with room for challenges.
+func openChallenges(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection to an in-memory database gets a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(&database.Challenge{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestVerifyChallenge(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member := database.Member{UniqueID: "member", PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+
+	tests := []struct {
+		name     string
+		member   database.Member
+		signer   ed25519.PrivateKey
+		signHost string
+		expired  bool // The nonce ran out before it was answered.
+		answered bool // The nonce was already answered once.
+		unknown  bool // The nonce was never handed out.
+		want     bool
+	}{
+		{
+			name:     "signed nonce",
+			member:   member,
+			signer:   privateKey,
+			signHost: testHost,
+			want:     true,
+		},
+		{
+			name:     "expired nonce",
+			member:   member,
+			signer:   privateKey,
+			signHost: testHost,
+			expired:  true,
+			want:     false,
+		},
+		{
+			name:     "reused nonce",
+			member:   member,
+			signer:   privateKey,
+			signHost: testHost,
+			answered: true,
+			want:     false,
+		},
+		{
+			name:     "nonce that was never handed out",
+			member:   member,
+			signer:   privateKey,
+			signHost: testHost,
+			unknown:  true,
+			want:     false,
+		},
+		{
+			name:     "signed for another host",
+			member:   member,
+			signer:   privateKey,
+			signHost: "evil.example.com:8000",
+			want:     false,
+		},
+		{
+			name:     "signed for the host without its port",
+			member:   member,
+			signer:   privateKey,
+			signHost: "chat.example.com",
+			want:     false,
+		},
+		{
+			name:     "signed with another key",
+			member:   member,
+			signer:   otherKey,
+			signHost: testHost,
+			want:     false,
+		},
+		{
+			name:     "member without a public key",
+			member:   database.Member{UniqueID: "member"},
+			signer:   privateKey,
+			signHost: testHost,
+			want:     false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := openChallenges(t)
+
+			challenge, err := NewChallenge(db, test.member.UniqueID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.expired {
+				if err := db.Model(&challenge).Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			nonce := challenge.Nonce
+			if test.unknown {
+				nonce = "never-handed-out"
+			}
+
+			signature := base64.StdEncoding.EncodeToString(ed25519.Sign(test.signer, ChallengeMessage(test.signHost, test.member.UniqueID, nonce)))
+
+			if test.answered {
+				answer := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, ChallengeMessage(testHost, member.UniqueID, nonce)))
+
+				if !VerifyChallenge(db, testHost, member, nonce, answer) {
+					t.Fatal("first answer was refused")
+				}
+			}
+
+			if got := VerifyChallenge(db, testHost, test.member, nonce, signature); got != test.want {
+				t.Errorf("VerifyChallenge() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// A failed answer uses the nonce up too, so it can't be guessed at.
+func TestVerifyChallengeUsesNonceUp(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member := database.Member{UniqueID: "member", PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+	db := openChallenges(t)
+
+	challenge, err := NewChallenge(db, member.UniqueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if VerifyChallenge(db, testHost, member, challenge.Nonce, "bm90IGEgc2lnbmF0dXJl") {
+		t.Fatal("a bad signature was accepted")
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, ChallengeMessage(testHost, member.UniqueID, challenge.Nonce)))
+
+	if VerifyChallenge(db, testHost, member, challenge.Nonce, signature) {
+		t.Error("the nonce could still be answered after a failed attempt")
+	}
+}
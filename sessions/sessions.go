@@ -0,0 +1,107 @@
+package sessions
+
+// Sessions are what members sign in with. The token handed out is random and
+// opaque, only its SHA-256 digest is stored, so a leaked database can't be
+// used to sign in. Tokens are long and random enough that a fast digest is fine.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// How many random bytes a token is made of.
+const tokenLength = 32
+
+// Sessions are only written to when they were last used longer ago than
+// this, so every request doesn't turn into a write.
+const touchInterval = time.Minute
+
+// Returns the digest a token is stored as.
+func Digest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	token := make([]byte, tokenLength)
+
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// New starts a session for the member and returns it along with its token.
+// The token can't be recovered later, so it has to be given to the member now.
+func New(tx *gorm.DB, memberID int, device string) (database.Session, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return database.Session{}, "", err
+	}
+
+	now := time.Now()
+
+	session := database.Session{
+		TokenHash:  Digest(token),
+		MemberID:   memberID,
+		Device:     device,
+		ExpiresAt:  now.Add(config.SessionLifetime),
+		LastUsedAt: now,
+	}
+
+	if err := tx.Create(&session).Error; err != nil {
+		return database.Session{}, "", err
+	}
+
+	return session, token, nil
+}
+
+// Authenticate finds the session the token belongs to, if it hasn't expired.
+func Authenticate(tx *gorm.DB, token string) (database.Session, bool) {
+	var session database.Session
+
+	if err := tx.Where("token_hash = ? AND expires_at > ?", Digest(token), time.Now()).First(&session).Error; err != nil {
+		return database.Session{}, false
+	}
+
+	if time.Since(session.LastUsedAt) > touchInterval {
+		session.LastUsedAt = time.Now()
+		tx.Model(&session).UpdateColumn("last_used_at", session.LastUsedAt)
+	}
+
+	return session, true
+}
+
+// Refresh swaps the session's token for a new one and pushes its expiry back.
+// The old token stops working straight away.
+func Refresh(tx *gorm.DB, session *database.Session) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	session.TokenHash = Digest(token)
+	session.ExpiresAt = now.Add(config.SessionLifetime)
+	session.LastUsedAt = now
+
+	if err := tx.Save(session).Error; err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// RevokeAll signs the member out everywhere.
+func RevokeAll(tx *gorm.DB, memberID int) error {
+	return tx.Where("member_id = ?", memberID).Delete(&database.Session{}).Error
+}
@@ -0,0 +1,124 @@
+package socket
+
+import (
+	"eskimoe-server/database"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+)
+
+const (
+	// Number of outbound messages a client may fall behind before it is dropped.
+	sendQueueSize = 64
+	// Maximum time a single write to a client may take.
+	writeWait = 10 * time.Second
+)
+
+type outbound struct {
+	messageType int
+	data        []byte
+}
+
+// Client is a single /ws/listen connection. Every write to the underlying
+// connection happens on the client's own writer goroutine, so a slow client
+// can never hold up the hub or the HTTP handlers broadcasting through it.
+type Client struct {
+	Conn      *websocket.Conn
+	Member    database.Member
+	SessionID int
+
+	send        chan outbound
+	done        chan struct{}
+	mu          sync.Mutex
+	closed      bool
+	closeCode   int
+	closeReason string
+}
+
+func NewClient(conn *websocket.Conn, member database.Member, sessionID int) *Client {
+	return &Client{
+		Conn:      conn,
+		Member:    member,
+		SessionID: sessionID,
+		send:      make(chan outbound, sendQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// Queue adds a text message to the client's outbound queue without blocking.
+// Returns false if the client is closed or its queue is full.
+func (c *Client) Queue(data []byte) bool {
+	return c.enqueue(outbound{messageType: websocket.TextMessage, data: data})
+}
+
+func (c *Client) enqueue(message outbound) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+
+	select {
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the client's writer after it has flushed its queue and sent a
+// close frame with the given code and reason. Closing twice is a no-op.
+func (c *Client) Close(code int, reason string) {
+	c.shutdown(code, reason, false)
+}
+
+// Drop closes the client like Close, but throws away whatever is still queued,
+// so a client that fell too far behind gets its close frame right away.
+func (c *Client) Drop(code int, reason string) {
+	c.shutdown(code, reason, true)
+}
+
+func (c *Client) shutdown(code int, reason string, discard bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	// Nothing is queued while c.mu is held, so this empties the queue for good
+	for discard && len(c.send) > 0 {
+		select {
+		case <-c.send:
+		default:
+		}
+	}
+
+	c.closed = true
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+// Done is closed once the writer goroutine has exited and the connection is no longer written to.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) writePump() {
+	defer close(c.done)
+
+	for message := range c.send {
+		c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.Conn.WriteMessage(message.messageType, message.data); err != nil {
+			c.Conn.Close()
+			return
+		}
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+	c.Conn.Close()
+}
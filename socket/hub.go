@@ -1,51 +1,345 @@
 package socket
 
 import (
-	"fmt"
+	"encoding/json"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofiber/contrib/websocket"
 )
 
+// Envelope is a broadcast along with who may receive it.
+// Broadcasts with a RoomID of 0 are server-wide and go to every client,
+// all others only go to clients subscribed to that room. If Permission is
+// set, only clients whose member holds it receive the broadcast, and
+// ExceptMemberID keeps a broadcast from echoing back to its own member.
+// Server-wide broadcasts about a room set ViewRoomID, so they only go to
+// clients that can see the room. Broadcasts carrying a category set
+// FilterRooms, and each client gets the category with only the rooms it can see.
+// Ephemeral broadcasts are not sequenced and never replayed.
+type Envelope struct {
+	RoomID         int
+	ViewRoomID     int
+	Permission     database.Permission
+	ExceptMemberID int
+	FilterRooms    bool
+	Ephemeral      bool
+	Broadcast      config.SocketBroadcast
+}
+
+// Subscription ties a client to a room it wants to receive broadcasts for.
+type Subscription struct {
+	Client *Client
+	RoomID int
+}
+
 type Hub struct {
-	Clients    map[*websocket.Conn]bool
-	Broadcast  chan []byte
-	Register   chan *websocket.Conn
-	Unregister chan *websocket.Conn
-	mu         sync.Mutex
+	Clients     map[*Client]bool
+	Rooms       map[int]map[*Client]bool
+	Members     map[int]*Presence
+	Broadcast   chan Envelope
+	Register    chan *Client
+	Unregister  chan *Client
+	Subscribe   chan Subscription
+	Unsubscribe chan Subscription
+	Resume      chan Resume
+	Activity    chan Activity
+	Typing      chan Subscription
+	Refresh     chan []int
+	Overwrites  chan int
+	Evict       chan Eviction
+	statuses    *statusWrites
+	events      chan database.SocketEvent
+	persisted   chan struct{}
+	stop        chan chan struct{}
+	overwrites  map[int][]database.RoomOverwrite
+	typing      map[typingKey]time.Time
+	epoch       int64
+	sequence    uint64
+	replay      []replayEntry
+	mu          sync.Mutex
+	// Set once a remembered event couldn't be saved.
+	persistFailed atomic.Bool
 }
 
 var WsHub = Hub{
-	Clients:    make(map[*websocket.Conn]bool),
-	Broadcast:  make(chan []byte),
-	Register:   make(chan *websocket.Conn),
-	Unregister: make(chan *websocket.Conn),
+	Clients:     make(map[*Client]bool),
+	Rooms:       make(map[int]map[*Client]bool),
+	Members:     make(map[int]*Presence),
+	Broadcast:   make(chan Envelope, 256),
+	Register:    make(chan *Client),
+	Unregister:  make(chan *Client),
+	Subscribe:   make(chan Subscription),
+	Unsubscribe: make(chan Subscription),
+	Resume:      make(chan Resume),
+	Activity:    make(chan Activity, 256),
+	Typing:      make(chan Subscription, 256),
+	Refresh:     make(chan []int, 16),
+	Overwrites:  make(chan int, 16),
+	Evict:       make(chan Eviction, 16),
+	statuses:    &statusWrites{pending: make(map[int]database.MemberStatus), ready: make(chan struct{}, 1)},
+	events:      make(chan database.SocketEvent, 1024),
+	persisted:   make(chan struct{}),
+	stop:        make(chan chan struct{}),
+	overwrites:  make(map[int][]database.RoomOverwrite),
+	typing:      make(map[typingKey]time.Time),
 }
 
 func (h *Hub) Run() {
+	resetPresence()
+	h.loadReplay()
+
+	go h.writeStatuses()
+	if config.ReplayPersist {
+		go h.persistReplay()
+	}
+
+	presenceTicker := time.NewTicker(presenceInterval)
+	defer presenceTicker.Stop()
+
 	for {
 		select {
-		case conn := <-h.Register:
+		case client := <-h.Register:
+			h.mu.Lock()
+			h.Clients[client] = true
+			h.startSession(client)
+			h.connect(client)
+			h.mu.Unlock()
+		case client := <-h.Unregister:
 			h.mu.Lock()
-			h.Clients[conn] = true
+			h.remove(client, websocket.CloseNormalClosure, "")
 			h.mu.Unlock()
-		case conn := <-h.Unregister:
+		case sub := <-h.Subscribe:
 			h.mu.Lock()
-			if _, ok := h.Clients[conn]; ok {
-				delete(h.Clients, conn)
-				conn.Close()
-			}
+			h.subscribe(sub.Client, sub.RoomID)
 			h.mu.Unlock()
-		case message := <-h.Broadcast:
-			fmt.Println(h.Clients)
+		case sub := <-h.Unsubscribe:
 			h.mu.Lock()
-			for conn := range h.Clients {
-				if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
-					conn.Close()
-					delete(h.Clients, conn)
-				}
-			}
+			h.unsubscribe(sub.Client, sub.RoomID)
 			h.mu.Unlock()
+		case resume := <-h.Resume:
+			h.mu.Lock()
+			h.resume(resume)
+			h.mu.Unlock()
+		case activity := <-h.Activity:
+			h.mu.Lock()
+			h.recordActivity(activity)
+			h.mu.Unlock()
+		case sub := <-h.Typing:
+			h.mu.Lock()
+			h.relayTyping(sub)
+			h.mu.Unlock()
+		case memberIDs := <-h.Refresh:
+			h.mu.Lock()
+			h.refresh(memberIDs)
+			h.mu.Unlock()
+		case roomID := <-h.Overwrites:
+			h.mu.Lock()
+			h.reloadOverwrites(roomID)
+			h.mu.Unlock()
+		case eviction := <-h.Evict:
+			h.mu.Lock()
+			h.evict(eviction)
+			h.mu.Unlock()
+		case <-presenceTicker.C:
+			h.mu.Lock()
+			h.markIdle()
+			h.forgetTyping()
+			h.mu.Unlock()
+		case envelope := <-h.Broadcast:
+			h.mu.Lock()
+			h.applyPending()
+			h.deliver(envelope)
+			h.mu.Unlock()
+		case done := <-h.stop:
+			h.mu.Lock()
+			h.saveReplay()
+			h.mu.Unlock()
+			close(done)
+			return
+		}
+	}
+}
+
+// Stop waits for the hub to save what it has to and stops it.
+// Nothing can be broadcast once it returns.
+func (h *Hub) Stop() {
+	done := make(chan struct{})
+	h.stop <- done
+	<-done
+}
+
+// applyPending reloads whatever members and overwrites changed before the
+// broadcast was sent. Channels are picked at random, so otherwise a broadcast
+// about a change could be filtered by what members could see before it.
+// The caller must hold h.mu.
+func (h *Hub) applyPending() {
+	for {
+		select {
+		case memberIDs := <-h.Refresh:
+			h.refresh(memberIDs)
+		case roomID := <-h.Overwrites:
+			h.reloadOverwrites(roomID)
+		default:
+			return
+		}
+	}
+}
+
+// deliver sequences the envelope and queues it on every client allowed to receive it.
+// The caller must hold h.mu.
+func (h *Hub) deliver(envelope Envelope) {
+	if !envelope.Ephemeral {
+		h.sequence++
+		envelope.Broadcast.Sequence = h.sequence
+	}
+
+	data, err := json.Marshal(envelope.Broadcast)
+	if err != nil {
+		log.Println("Error Encoding Broadcast:", err)
+		return
+	}
+
+	if !envelope.Ephemeral {
+		h.remember(envelope, data)
+	}
+
+	recipients := h.Clients
+	if envelope.RoomID != 0 {
+		recipients = h.Rooms[envelope.RoomID]
+	}
+
+	for client := range recipients {
+		if !h.allowed(client, envelope) {
+			continue
+		}
+		// Never wait on a client, drop it once it falls too far behind.
+		if !client.Queue(h.visible(client, envelope, data)) {
+			h.drop(client)
 		}
 	}
 }
+
+// allowed reports whether the client may receive the envelope.
+// The caller must hold h.mu.
+func (h *Hub) allowed(client *Client, envelope Envelope) bool {
+	if envelope.ExceptMemberID != 0 && client.Member.ID == envelope.ExceptMemberID {
+		return false
+	}
+
+	if envelope.RoomID == 0 {
+		if envelope.ViewRoomID != 0 && !permissions.CanView(h.roomPermissions(client, envelope.ViewRoomID)) {
+			return false
+		}
+
+		return envelope.Permission == "" || permissions.Has(client.Member, envelope.Permission)
+	}
+
+	if !h.Rooms[envelope.RoomID][client] {
+		return false
+	}
+
+	roomPermissions := h.roomPermissions(client, envelope.RoomID)
+
+	return permissions.CanView(roomPermissions) && (envelope.Permission == "" || roomPermissions.Has(envelope.Permission))
+}
+
+// remove closes the client and drops it from the hub along with all of its subscriptions.
+// The caller must hold h.mu.
+func (h *Hub) remove(client *Client, code int, reason string) {
+	if _, ok := h.Clients[client]; !ok {
+		return
+	}
+
+	for roomID := range h.Rooms {
+		h.unsubscribe(client, roomID)
+	}
+
+	delete(h.Clients, client)
+	client.Close(code, reason)
+	h.disconnect(client)
+}
+
+// drop removes a client that fell too far behind without waiting for it to catch up.
+// The caller must hold h.mu.
+func (h *Hub) drop(client *Client) {
+	client.Drop(websocket.CloseTryAgainLater, "Slow Consumer")
+	h.remove(client, websocket.CloseTryAgainLater, "Slow Consumer")
+}
+
+// refresh reloads the given members, or every connected member if none are given,
+// so that broadcasts are filtered by their current roles. Members are unsubscribed
+// from the rooms their new roles no longer let them see.
+// The caller must hold h.mu.
+func (h *Hub) refresh(memberIDs []int) {
+	if len(memberIDs) == 0 {
+		for memberID := range h.Members {
+			memberIDs = append(memberIDs, memberID)
+		}
+	}
+
+	if len(memberIDs) == 0 {
+		return
+	}
+
+	var members []database.Member
+	if err := database.Database.Preload("Roles").Where("id IN ?", memberIDs).Find(&members).Error; err != nil {
+		log.Println("Error Refreshing Members:", err)
+		return
+	}
+
+	for _, member := range members {
+		presence, ok := h.Members[member.ID]
+		if !ok {
+			continue
+		}
+
+		member.Status = presence.Member.Status
+		presence.Member = member
+
+		for client := range presence.Clients {
+			client.Member = member
+		}
+	}
+
+	for roomID := range h.Rooms {
+		h.prune(roomID)
+	}
+}
+
+// Clients can only subscribe to rooms they can see.
+// The caller must hold h.mu.
+func (h *Hub) subscribe(client *Client, roomID int) {
+	if _, ok := h.Clients[client]; !ok {
+		return
+	}
+
+	if !permissions.CanView(h.roomPermissions(client, roomID)) {
+		return
+	}
+
+	if h.Rooms[roomID] == nil {
+		h.Rooms[roomID] = make(map[*Client]bool)
+	}
+
+	h.Rooms[roomID][client] = true
+}
+
+// The caller must hold h.mu.
+func (h *Hub) unsubscribe(client *Client, roomID int) {
+	subscribers, ok := h.Rooms[roomID]
+	if !ok {
+		return
+	}
+
+	delete(subscribers, client)
+
+	if len(subscribers) == 0 {
+		delete(h.Rooms, roomID)
+	}
+}
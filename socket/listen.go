@@ -0,0 +1,106 @@
+package socket
+
+import (
+	"encoding/json"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/ratelimit"
+	"log"
+
+	"github.com/gofiber/contrib/websocket"
+)
+
+type FrameType string
+
+const (
+	SubscribeFrame   FrameType = "subscribe"
+	UnsubscribeFrame FrameType = "unsubscribe"
+	IdleFrame        FrameType = "idle"
+	ActiveFrame      FrameType = "active"
+	TypingFrame      FrameType = "typing"
+	ResumeFrame      FrameType = "resume"
+)
+
+// Frame is a JSON message sent by a client over /ws/listen.
+// Epoch, Sequence and Rooms are only used by resume frames.
+type Frame struct {
+	Type     FrameType `json:"type"`
+	RoomID   int       `json:"room_id"`
+	Epoch    int64     `json:"epoch"`
+	Sequence uint64    `json:"seq"`
+	Rooms    []int     `json:"rooms"`
+}
+
+// Listen handles a single /ws/listen connection for its whole lifetime.
+func Listen(c *websocket.Conn) {
+	member, ok := c.Locals("Member").(database.Member)
+	session, sessionOk := c.Locals("Session").(database.Session)
+	if !ok || !sessionOk {
+		log.Println("Unauthorized Member Disconnected")
+		c.Close()
+		return
+	}
+
+	log.Println("Connected Member", member.DisplayName)
+
+	// Frames too large are refused by the connection itself, frames too frequent below
+	c.SetReadLimit(config.SocketFrameSize)
+	frameLimit := ratelimit.NewBucket(config.SocketRateLimit.Requests, config.SocketRateLimit.Per)
+
+	client := NewClient(c, member, session.ID)
+	go client.writePump()
+
+	WsHub.Register <- client
+	defer func() {
+		WsHub.Unregister <- client
+		// The connection is released once Listen returns, so wait for the writer to let go of it.
+		<-client.Done()
+	}()
+
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			log.Println("Read Error:", err)
+			return
+		}
+
+		if allowed, _ := frameLimit.Allow(); !allowed {
+			log.Println("Rate Limited Member", member.DisplayName)
+			client.Close(websocket.ClosePolicyViolation, "Rate Limited")
+			return
+		}
+
+		// Handle Ping messages
+		if string(msg) == string(rune(websocket.PingMessage)) {
+			client.enqueue(outbound{messageType: websocket.PongMessage, data: []byte(string(rune(websocket.PongMessage)))})
+			continue
+		}
+
+		var frame Frame
+		if err := json.Unmarshal(msg, &frame); err != nil {
+			continue
+		}
+
+		// Anything but an idle frame counts as the member being active
+		WsHub.Activity <- Activity{MemberID: member.ID, Idle: frame.Type == IdleFrame}
+
+		switch frame.Type {
+		case SubscribeFrame:
+			var room database.Room
+			if database.Database.First(&room, frame.RoomID).Error != nil {
+				continue
+			}
+			WsHub.Subscribe <- Subscription{Client: client, RoomID: room.ID}
+		case UnsubscribeFrame:
+			WsHub.Unsubscribe <- Subscription{Client: client, RoomID: frame.RoomID}
+		case ResumeFrame:
+			var rooms []int
+			if len(frame.Rooms) > 0 {
+				database.Database.Model(&database.Room{}).Where("id IN ?", frame.Rooms).Pluck("id", &rooms)
+			}
+			WsHub.Resume <- Resume{Client: client, Epoch: frame.Epoch, Sequence: frame.Sequence, Rooms: rooms}
+		case TypingFrame:
+			WsHub.Typing <- Subscription{Client: client, RoomID: frame.RoomID}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package socket
+
+import (
+	"encoding/json"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/permissions"
+	"log"
+)
+
+// roomPermissions resolves the client's permissions in the room. The room's
+// overwrites are loaded once and kept until they change. If they can't be
+// loaded, the client gets no permissions in the room rather than too many.
+// The caller must hold h.mu.
+func (h *Hub) roomPermissions(client *Client, roomID int) permissions.Set {
+	overwrites, ok := h.overwrites[roomID]
+
+	if !ok {
+		overwrites = []database.RoomOverwrite{}
+
+		if err := database.Database.Where("room_id = ?", roomID).Find(&overwrites).Error; err != nil {
+			log.Println("Error Loading Overwrites:", err)
+			return permissions.Set{}
+		}
+
+		h.overwrites[roomID] = overwrites
+	}
+
+	return permissions.InRoom(client.Member, overwrites)
+}
+
+// reloadOverwrites forgets the room's overwrites so they are loaded again,
+// and unsubscribes the clients that can no longer see the room.
+// The caller must hold h.mu.
+func (h *Hub) reloadOverwrites(roomID int) {
+	delete(h.overwrites, roomID)
+	h.prune(roomID)
+}
+
+// prune unsubscribes every client that can no longer see the room.
+// The caller must hold h.mu.
+func (h *Hub) prune(roomID int) {
+	for client := range h.Rooms[roomID] {
+		if !permissions.CanView(h.roomPermissions(client, roomID)) {
+			h.unsubscribe(client, roomID)
+		}
+	}
+}
+
+// visible returns what the client gets of the envelope's data. Categories
+// are re-encoded with only the rooms the client can see, so hidden rooms
+// don't show up in their room list or order.
+// The caller must hold h.mu.
+func (h *Hub) visible(client *Client, envelope Envelope, data []byte) []byte {
+	if !envelope.FilterRooms {
+		return data
+	}
+
+	var category database.Category
+	broadcast := config.SocketBroadcast{Data: &category}
+	if err := json.Unmarshal(data, &broadcast); err != nil {
+		log.Println("Error Decoding Category:", err)
+		return data
+	}
+
+	rooms := []database.Room{}
+	for _, room := range category.Rooms {
+		if permissions.CanView(h.roomPermissions(client, room.ID)) {
+			rooms = append(rooms, room)
+		}
+	}
+	category.Rooms = rooms
+
+	roomOrder := []int{}
+	for _, roomID := range category.RoomOrder {
+		if permissions.CanView(h.roomPermissions(client, roomID)) {
+			roomOrder = append(roomOrder, roomID)
+		}
+	}
+	category.RoomOrder = roomOrder
+
+	filtered, err := json.Marshal(broadcast)
+	if err != nil {
+		log.Println("Error Encoding Category:", err)
+		return data
+	}
+
+	return filtered
+}
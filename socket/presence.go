@@ -0,0 +1,198 @@
+package socket
+
+import (
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+)
+
+// How often the hub looks for members that have gone idle.
+const presenceInterval = 15 * time.Second
+
+// Presence is the live status of a member with at least one open connection.
+type Presence struct {
+	Member     database.Member
+	Clients    map[*Client]bool
+	LastActive time.Time
+}
+
+// Activity reports that a member did something, or explicitly went idle.
+type Activity struct {
+	MemberID int
+	Idle     bool
+}
+
+// Eviction closes every connection of a member that was removed from the server,
+// or only those opened with a session if SessionID is set.
+// The reason is sent to the client as the close reason.
+type Eviction struct {
+	MemberID  int
+	SessionID int
+	Reason    string
+}
+
+// statusWrites are the status changes waiting to be saved, only the latest
+// one of each member. They have a lock of their own, so queueing a change
+// never waits on a write in progress.
+type statusWrites struct {
+	pending map[int]database.MemberStatus
+	ready   chan struct{}
+	mu      sync.Mutex
+}
+
+// resetPresence marks every member offline, no one is connected before the hub starts.
+func resetPresence() {
+	if err := database.Database.Model(&database.Member{}).
+		Where("status IN ?", []database.MemberStatus{database.Online, database.Idle}).
+		Update("status", database.Offline).Error; err != nil {
+		log.Println("Error Resetting Presence:", err)
+	}
+}
+
+// The caller must hold h.mu.
+func (h *Hub) connect(client *Client) {
+	presence, ok := h.Members[client.Member.ID]
+	if !ok {
+		presence = &Presence{
+			Member:  client.Member,
+			Clients: make(map[*Client]bool),
+		}
+		h.Members[client.Member.ID] = presence
+	}
+
+	presence.Clients[client] = true
+	presence.LastActive = time.Now()
+
+	// The first connection brings the member online, as does a new connection while idle
+	if !ok || presence.Member.Status != database.Online {
+		h.setStatus(presence, database.Online)
+	}
+}
+
+// The caller must hold h.mu.
+func (h *Hub) disconnect(client *Client) {
+	presence, ok := h.Members[client.Member.ID]
+	if !ok {
+		return
+	}
+
+	delete(presence.Clients, client)
+
+	if len(presence.Clients) == 0 {
+		delete(h.Members, client.Member.ID)
+		h.setStatus(presence, database.Offline)
+	}
+}
+
+// evict closes the member's connections without touching its status,
+// which whoever removed the member has already set. Closing the connections
+// of a single session leaves the member connected everywhere else.
+// The caller must hold h.mu.
+func (h *Hub) evict(eviction Eviction) {
+	presence, ok := h.Members[eviction.MemberID]
+	if !ok {
+		return
+	}
+
+	if eviction.SessionID != 0 {
+		for client := range presence.Clients {
+			if client.SessionID == eviction.SessionID {
+				h.remove(client, websocket.ClosePolicyViolation, eviction.Reason)
+			}
+		}
+		return
+	}
+
+	delete(h.Members, eviction.MemberID)
+
+	for client := range presence.Clients {
+		h.remove(client, websocket.ClosePolicyViolation, eviction.Reason)
+	}
+}
+
+// The caller must hold h.mu.
+func (h *Hub) recordActivity(activity Activity) {
+	presence, ok := h.Members[activity.MemberID]
+	if !ok {
+		return
+	}
+
+	if activity.Idle {
+		if presence.Member.Status == database.Online {
+			h.setStatus(presence, database.Idle)
+		}
+		return
+	}
+
+	presence.LastActive = time.Now()
+
+	if presence.Member.Status == database.Idle {
+		h.setStatus(presence, database.Online)
+	}
+}
+
+// The caller must hold h.mu.
+func (h *Hub) markIdle() {
+	for _, presence := range h.Members {
+		if presence.Member.Status == database.Online && time.Since(presence.LastActive) > config.IdleTimeout {
+			h.setStatus(presence, database.Idle)
+		}
+	}
+}
+
+// setStatus tells everyone about the member's new status and leaves saving
+// it to writeStatuses, so the hub never waits on the database.
+// The caller must hold h.mu.
+func (h *Hub) setStatus(presence *Presence, status database.MemberStatus) {
+	presence.Member.Status = status
+
+	h.statuses.queue(presence.Member.ID, status)
+
+	h.deliver(Envelope{Broadcast: config.SocketBroadcast{
+		BroadcastType: config.MemberUpdated,
+		Data:          presence.Member,
+	}})
+}
+
+// queue replaces whatever status change of the member is still waiting to
+// be saved and wakes writeStatuses up, without ever waiting on it.
+func (w *statusWrites) queue(memberID int, status database.MemberStatus) {
+	w.mu.Lock()
+	w.pending[memberID] = status
+	w.mu.Unlock()
+
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take hands over every status change waiting to be saved.
+func (w *statusWrites) take() map[int]database.MemberStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending := w.pending
+	w.pending = make(map[int]database.MemberStatus)
+
+	return pending
+}
+
+// writeStatuses saves the latest status of every member that changed since
+// the last write. Members that left or were removed in the meantime keep
+// their status.
+func (h *Hub) writeStatuses() {
+	for range h.statuses.ready {
+		for memberID, status := range h.statuses.take() {
+			if err := database.Database.Model(&database.Member{}).
+				Where("id = ? AND status NOT IN ?", memberID, database.DepartedStatuses).
+				Update("status", status).Error; err != nil {
+				log.Println("Error Updating Presence:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package socket
+
+import (
+	"encoding/json"
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// Most events saved with a single insert.
+	replayBatchSize = 128
+	// How often saved events that have fallen out of the buffer are dropped.
+	replayTrimInterval = time.Minute
+)
+
+// Resume asks the hub to replay everything a reconnecting client missed.
+// Epoch and Sequence come from the last SessionStarted or broadcast the
+// client saw, Rooms are the rooms it was subscribed to before it dropped.
+type Resume struct {
+	Client   *Client
+	Epoch    int64
+	Sequence uint64
+	Rooms    []int
+}
+
+type Session struct {
+	Epoch    int64  `json:"epoch"`
+	Sequence uint64 `json:"seq"`
+}
+
+type ReplayedEvents struct {
+	Session
+	Events []json.RawMessage `json:"events"`
+}
+
+type replayEntry struct {
+	Sequence uint64
+	Envelope Envelope
+	Data     []byte
+}
+
+// loadReplay picks up the epoch and sequence where the last run left them,
+// so clients can resume across restarts when the buffer is persisted. That
+// only holds after a clean shutdown, anything else may have lost events
+// clients already saw, so a new epoch tells clients their sequence is stale.
+func (h *Hub) loadReplay() {
+	h.epoch = time.Now().UnixNano()
+
+	if !config.ReplayPersist {
+		return
+	}
+
+	// The state is used up, so a crash from here on can't pass for a clean shutdown
+	var state database.ReplayState
+	clean := database.Database.Order("id desc").Limit(1).Find(&state).Error == nil && state.ID != 0
+
+	if err := database.Database.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&database.ReplayState{}).Error; err != nil {
+		log.Println("Error Loading Replay Buffer:", err)
+		clean = false
+	}
+
+	var events []database.SocketEvent
+	if clean {
+		if err := database.Database.Order("sequence desc").Limit(config.ReplayBufferSize).Find(&events).Error; err != nil {
+			log.Println("Error Loading Replay Buffer:", err)
+			clean = false
+		}
+	}
+
+	if !clean || (len(events) > 0 && events[0].Sequence != state.Sequence) {
+		log.Println("Replay Buffer Incomplete, Starting a New Epoch")
+		h.discardReplay()
+		return
+	}
+
+	h.epoch = state.Epoch
+	h.sequence = state.Sequence
+
+	for i := len(events) - 1; i >= 0; i-- {
+		h.replay = append(h.replay, replayEntry{
+			Sequence: events[i].Sequence,
+			Envelope: Envelope{
+				RoomID:         events[i].RoomID,
+				ViewRoomID:     events[i].ViewRoomID,
+				Permission:     events[i].Permission,
+				ExceptMemberID: events[i].ExceptMemberID,
+				FilterRooms:    events[i].FilterRooms,
+			},
+			Data: events[i].Data,
+		})
+	}
+}
+
+// discardReplay drops the saved events of an epoch that is over.
+func (h *Hub) discardReplay() {
+	if err := database.Database.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&database.SocketEvent{}).Error; err != nil {
+		log.Println("Error Discarding Replay Buffer:", err)
+		// Saving over the old events fails from here on, so the next run can't resume either
+		h.persistFailed.Store(true)
+	}
+}
+
+// saveReplay waits for every remembered event to be saved, then leaves the
+// epoch and sequence for the next run to carry on with. If any event went
+// unsaved the next run starts a new epoch instead.
+// The caller must hold h.mu.
+func (h *Hub) saveReplay() {
+	if !config.ReplayPersist {
+		return
+	}
+
+	close(h.events)
+	<-h.persisted
+
+	if h.persistFailed.Load() {
+		log.Println("Replay Buffer Incomplete, Clients Will Resync")
+		return
+	}
+
+	if err := database.Database.Create(&database.ReplayState{Epoch: h.epoch, Sequence: h.sequence}).Error; err != nil {
+		log.Println("Error Saving Replay Buffer:", err)
+	}
+}
+
+// remember keeps a sequenced broadcast for replay.
+// The caller must hold h.mu.
+func (h *Hub) remember(envelope Envelope, data []byte) {
+	h.replay = append(h.replay, replayEntry{Sequence: envelope.Broadcast.Sequence, Envelope: envelope, Data: data})
+	if len(h.replay) > config.ReplayBufferSize {
+		h.replay = h.replay[len(h.replay)-config.ReplayBufferSize:]
+	}
+
+	if !config.ReplayPersist {
+		return
+	}
+
+	// Saved by persistReplay, so the hub never waits on the database. An
+	// event that can't be queued leaves a gap, so the saved events are only
+	// good for this run.
+	select {
+	case h.events <- database.SocketEvent{
+		Sequence:       envelope.Broadcast.Sequence,
+		RoomID:         envelope.RoomID,
+		ViewRoomID:     envelope.ViewRoomID,
+		Permission:     envelope.Permission,
+		ExceptMemberID: envelope.ExceptMemberID,
+		FilterRooms:    envelope.FilterRooms,
+		Data:           data,
+	}:
+	default:
+		if !h.persistFailed.Swap(true) {
+			log.Println("Error Persisting Socket Events: Queue Full")
+		}
+	}
+}
+
+// persistReplay saves remembered events, batching whatever has piled up
+// since the last insert, and drops saved events that have fallen out of the
+// buffer every now and then. It returns once the events are closed and saved.
+func (h *Hub) persistReplay() {
+	defer close(h.persisted)
+
+	trimTicker := time.NewTicker(replayTrimInterval)
+	defer trimTicker.Stop()
+
+	var latest uint64
+
+	for {
+		select {
+		case event, ok := <-h.events:
+			if !ok {
+				return
+			}
+
+			events := []database.SocketEvent{event}
+
+		collect:
+			for len(events) < replayBatchSize {
+				select {
+				case event, ok := <-h.events:
+					if !ok {
+						break collect
+					}
+					events = append(events, event)
+				default:
+					break collect
+				}
+			}
+
+			if err := database.Database.Create(&events).Error; err != nil {
+				log.Println("Error Persisting Socket Events:", err)
+				h.persistFailed.Store(true)
+				continue
+			}
+
+			latest = events[len(events)-1].Sequence
+		case <-trimTicker.C:
+			if latest <= uint64(config.ReplayBufferSize) {
+				continue
+			}
+
+			if err := database.Database.Where("sequence <= ?", latest-uint64(config.ReplayBufferSize)).Delete(&database.SocketEvent{}).Error; err != nil {
+				log.Println("Error Trimming Replay Buffer:", err)
+			}
+		}
+	}
+}
+
+// The caller must hold h.mu.
+func (h *Hub) startSession(client *Client) {
+	h.send(client, config.SocketBroadcast{
+		BroadcastType: config.SessionStarted,
+		Data:          Session{Epoch: h.epoch, Sequence: h.sequence},
+	})
+}
+
+// resume resubscribes the client and sends it every event it missed in a single frame.
+// If the events are no longer buffered, the client is told to resync from the API instead.
+// The caller must hold h.mu.
+func (h *Hub) resume(resume Resume) {
+	if _, ok := h.Clients[resume.Client]; !ok {
+		return
+	}
+
+	for _, roomID := range resume.Rooms {
+		h.subscribe(resume.Client, roomID)
+	}
+
+	session := Session{Epoch: h.epoch, Sequence: h.sequence}
+
+	oldest := h.sequence + 1
+	if len(h.replay) > 0 {
+		oldest = h.replay[0].Sequence
+	}
+
+	if resume.Epoch != h.epoch || resume.Sequence > h.sequence || resume.Sequence+1 < oldest {
+		h.send(resume.Client, config.SocketBroadcast{
+			BroadcastType: config.ResyncRequired,
+			Data:          session,
+		})
+		return
+	}
+
+	events := []json.RawMessage{}
+	for _, entry := range h.replay {
+		if entry.Sequence > resume.Sequence && h.allowed(resume.Client, entry.Envelope) {
+			events = append(events, h.visible(resume.Client, entry.Envelope, entry.Data))
+		}
+	}
+
+	h.send(resume.Client, config.SocketBroadcast{
+		BroadcastType: config.SessionResumed,
+		Data:          ReplayedEvents{Session: session, Events: events},
+	})
+}
+
+// send queues a broadcast for a single client, outside of the sequence.
+// The caller must hold h.mu.
+func (h *Hub) send(client *Client, broadcast config.SocketBroadcast) {
+	data, err := json.Marshal(broadcast)
+	if err != nil {
+		log.Println("Error Encoding Broadcast:", err)
+		return
+	}
+
+	if !client.Queue(data) {
+		h.drop(client)
+	}
+}
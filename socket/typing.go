@@ -0,0 +1,72 @@
+package socket
+
+import (
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"time"
+)
+
+const (
+	// Minimum time between two typing events from the same member in the same room.
+	typingThrottle = 3 * time.Second
+	// How long clients should show a typing indicator unless it is renewed.
+	typingTimeout = 8 * time.Second
+)
+
+type typingKey struct {
+	MemberID int
+	RoomID   int
+}
+
+type TypingEvent struct {
+	RoomID      int       `json:"room_id"`
+	UniqueID    string    `json:"uid"`
+	DisplayName string    `json:"display_name"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// relayTyping tells the other subscribers of a room that the client's member is typing.
+// Only subscribers who can send messages may type in a room, and repeated frames are throttled.
+// The caller must hold h.mu.
+func (h *Hub) relayTyping(sub Subscription) {
+	if !h.Rooms[sub.RoomID][sub.Client] || !h.roomPermissions(sub.Client, sub.RoomID).Has(database.SendMessage) {
+		return
+	}
+
+	if sub.Client.Member.Muted() {
+		return
+	}
+
+	key := typingKey{MemberID: sub.Client.Member.ID, RoomID: sub.RoomID}
+	now := time.Now()
+
+	if last, ok := h.typing[key]; ok && now.Sub(last) < typingThrottle {
+		return
+	}
+	h.typing[key] = now
+
+	h.deliver(Envelope{
+		RoomID:         sub.RoomID,
+		ExceptMemberID: sub.Client.Member.ID,
+		Ephemeral:      true,
+		Broadcast: config.SocketBroadcast{
+			BroadcastType: config.MemberTyping,
+			Data: TypingEvent{
+				RoomID:      sub.RoomID,
+				UniqueID:    sub.Client.Member.UniqueID,
+				DisplayName: sub.Client.Member.DisplayName,
+				ExpiresAt:   now.Add(typingTimeout),
+			},
+		},
+	})
+}
+
+// forgetTyping drops throttle entries old enough to no longer matter.
+// The caller must hold h.mu.
+func (h *Hub) forgetTyping() {
+	for key, last := range h.typing {
+		if time.Since(last) >= typingThrottle {
+			delete(h.typing, key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+// Helpers for the ID order slices kept on servers and categories (CategoryOrder, RoomOrder, RoleOrder).
+
+// Returns the order without the given ID.
+func WithoutID(order []int, id int) []int {
+	result := []int{}
+
+	for _, orderID := range order {
+		if orderID != id {
+			result = append(result, orderID)
+		}
+	}
+
+	return result
+}
+
+// Returns the order with the ID placed at the given position. Positions past
+// the end of the order, or negative ones, place the ID last.
+func InsertID(order []int, id int, position int) []int {
+	if position < 0 || position > len(order) {
+		position = len(order)
+	}
+
+	result := append([]int{}, order[:position]...)
+	result = append(result, id)
+
+	return append(result, order[position:]...)
+}
+
+// Returns the IDs sorted by where they appear in the order. IDs missing from the order come last.
+func OrderedIDs(order []int, ids []int) []int {
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	result := []int{}
+	for _, id := range order {
+		if wanted[id] {
+			result = append(result, id)
+			delete(wanted, id)
+		}
+	}
+
+	for _, id := range ids {
+		if wanted[id] {
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
+
+// Reports whether the order contains exactly the given IDs, each of them once.
+func SameIDs(order []int, ids []int) bool {
+	if len(order) != len(ids) {
+		return false
+	}
+
+	remaining := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		remaining[id] = true
+	}
+
+	for _, id := range order {
+		if !remaining[id] {
+			return false
+		}
+		delete(remaining, id)
+	}
+
+	return len(remaining) == 0
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWithoutID(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+		id    int
+		want  []int
+	}{
+		{"removes the id", []int{3, 1, 2}, 1, []int{3, 2}},
+		{"missing id", []int{3, 1, 2}, 4, []int{3, 1, 2}},
+		{"removes every copy", []int{1, 2, 1}, 1, []int{2}},
+		{"empty order", nil, 1, []int{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := WithoutID(test.order, test.id); !slices.Equal(got, test.want) {
+				t.Errorf("WithoutID(%v, %d) = %v, want %v", test.order, test.id, got, test.want)
+			}
+		})
+	}
+}
+
+func TestInsertID(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    []int
+		id       int
+		position int
+		want     []int
+	}{
+		{"first", []int{1, 2}, 3, 0, []int{3, 1, 2}},
+		{"middle", []int{1, 2}, 3, 1, []int{1, 3, 2}},
+		{"last", []int{1, 2}, 3, 2, []int{1, 2, 3}},
+		{"past the end", []int{1, 2}, 3, 5, []int{1, 2, 3}},
+		{"negative is last", []int{1, 2}, 3, -1, []int{1, 2, 3}},
+		{"far negative is last", []int{1, 2}, 3, -5, []int{1, 2, 3}},
+		{"empty order", nil, 3, 0, []int{3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order := slices.Clone(test.order)
+
+			if got := InsertID(order, test.id, test.position); !slices.Equal(got, test.want) {
+				t.Errorf("InsertID(%v, %d, %d) = %v, want %v", test.order, test.id, test.position, got, test.want)
+			}
+
+			if !slices.Equal(order, test.order) {
+				t.Errorf("InsertID changed the order it was given to %v", order)
+			}
+		})
+	}
+}
+
+func TestOrderedIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+		ids   []int
+		want  []int
+	}{
+		{"follows the order", []int{3, 1, 2}, []int{1, 2, 3}, []int{3, 1, 2}},
+		{"drops ids no longer there", []int{3, 1, 2}, []int{1, 2}, []int{1, 2}},
+		{"missing ids come last", []int{3, 1}, []int{1, 2, 3, 4}, []int{3, 1, 2, 4}},
+		{"repeated ids in the order", []int{1, 2, 1}, []int{1, 2}, []int{1, 2}},
+		{"empty order", nil, []int{2, 1}, []int{2, 1}},
+		{"no ids", []int{1, 2}, nil, []int{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := OrderedIDs(test.order, test.ids); !slices.Equal(got, test.want) {
+				t.Errorf("OrderedIDs(%v, %v) = %v, want %v", test.order, test.ids, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSameIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+		ids   []int
+		want  bool
+	}{
+		{"same ids in another order", []int{3, 1, 2}, []int{1, 2, 3}, true},
+		{"both empty", nil, []int{}, true},
+		{"missing id", []int{1, 2}, []int{1, 2, 3}, false},
+		{"extra id", []int{1, 2, 3}, []int{1, 2}, false},
+		{"other id", []int{1, 4}, []int{1, 2}, false},
+		{"repeated id", []int{1, 1}, []int{1, 2}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := SameIDs(test.order, test.ids); got != test.want {
+				t.Errorf("SameIDs(%v, %v) = %v, want %v", test.order, test.ids, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package workers
+
+import (
+	"eskimoe-server/config"
+	"eskimoe-server/database"
+	"eskimoe-server/socket"
+	"log"
+	"time"
+)
+
+// How often expired mutes are looked for. Mutes are enforced by their
+// end time, so this only affects how soon everyone is told about it.
+const muteInterval = 5 * time.Second
+
+// ExpireMutes lifts mutes once they run out and tells everyone about it.
+func ExpireMutes() {
+	ticker := time.NewTicker(muteInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expireMutes()
+	}
+}
+
+func expireMutes() {
+	db := database.Database
+
+	var members []database.Member
+
+	if err := db.Preload("Roles").Where("muted_until IS NOT NULL AND muted_until <= ?", time.Now()).Find(&members).Error; err != nil {
+		log.Println("Error Finding Muted Members:", err)
+		return
+	}
+
+	unmuted := []int{}
+
+	for _, member := range members {
+		// Leave the member alone if it was muted again in the meantime
+		result := db.Model(&database.Member{}).
+			Where("id = ? AND muted_until = ?", member.ID, member.MutedUntil).
+			Update("muted_until", nil)
+
+		if result.Error != nil {
+			log.Println("Error Lifting Mute:", result.Error)
+			continue
+		}
+
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		member.MutedUntil = nil
+		unmuted = append(unmuted, member.ID)
+
+		socket.WsHub.Broadcast <- socket.Envelope{Broadcast: config.SocketBroadcast{
+			BroadcastType: config.MemberUpdated,
+			Data:          member,
+		}}
+	}
+
+	if len(unmuted) > 0 {
+		socket.WsHub.Refresh <- unmuted
+	}
+}
@@ -0,0 +1,27 @@
+package workers
+
+import (
+	"eskimoe-server/database"
+	"log"
+	"time"
+)
+
+// How often expired sessions and challenges are deleted. They are already
+// refused once expired, this only keeps the tables from growing.
+const sessionInterval = time.Hour
+
+// PurgeSessions deletes sessions and challenges once they expire.
+func PurgeSessions() {
+	ticker := time.NewTicker(sessionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := database.Database.Where("expires_at <= ?", time.Now()).Delete(&database.Session{}).Error; err != nil {
+			log.Println("Error Purging Sessions:", err)
+		}
+
+		if err := database.Database.Where("expires_at <= ?", time.Now()).Delete(&database.Challenge{}).Error; err != nil {
+			log.Println("Error Purging Challenges:", err)
+		}
+	}
+}